@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// loadTopology reads the topology file at path, or the built-in one if path
+// is empty, and makes sure the routing constants match it.
+func loadTopology(path string) (*pubsub.Topology, error) {
+	var topology *pubsub.Topology
+	var err error
+	if path == "" {
+		topology, err = pubsub.ParseTopology(routing.TopologySpec)
+	} else {
+		topology, err = pubsub.LoadTopology(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := validateRoutes(topology); err != nil {
+		return nil, fmt.Errorf("topology does not match the routing constants: %w", err)
+	}
+	return topology, nil
+}
+
+// validateRoutes checks that everything the game publishes to or consumes
+// from is declared.
+func validateRoutes(t *pubsub.Topology) error {
+	var errs []error
+	for _, exchange := range []string{routing.ExchangePerilDirect, routing.ExchangePerilTopic, routing.ExchangePerilDLX} {
+		if !t.HasExchange(exchange) {
+			errs = append(errs, fmt.Errorf("exchange %s is missing", exchange))
+		}
+	}
+	bindings := []pubsub.BindingSpec{
+		{Exchange: routing.ExchangePerilDLX, Queue: routing.DeadLetterQueue, Key: ""},
+		{Exchange: routing.ExchangePerilTopic, Queue: routing.GameLogSlug, Key: routing.GameLogSlug + ".*"},
+		{Exchange: routing.ExchangePerilTopic, Queue: routing.WarRecognitionsPrefix, Key: routing.WarRecognitionsPrefix + ".*"},
+	}
+	for _, key := range []string{routing.JoinKey, routing.LeaveKey, routing.PlayersKey, routing.PauseStateKey, routing.GameKeyKey} {
+		bindings = append(bindings, pubsub.BindingSpec{Exchange: routing.ExchangePerilDirect, Queue: key, Key: key})
+	}
+	for _, b := range bindings {
+		if !t.HasQueue(b.Queue) {
+			errs = append(errs, fmt.Errorf("queue %s is missing", b.Queue))
+		}
+		if !t.HasBinding(b.Exchange, b.Queue, b.Key) {
+			errs = append(errs, fmt.Errorf("binding %s -> %s with %q is missing", b.Exchange, b.Queue, b.Key))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkTopology prints how the broker differs from topology and reports
+// whether it matches.
+func checkTopology(url string, topology *pubsub.Topology) (bool, error) {
+	// a plain connection, declarations that fail are expected here
+	connection, err := pubsub.Dial(url)
+	if err != nil {
+		return false, err
+	}
+	defer connection.Close()
+	diffs, err := topology.Check(connection)
+	if err != nil {
+		return false, err
+	}
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	if len(diffs) == 0 {
+		fmt.Println("Topology is up to date.")
+	}
+	return len(diffs) == 0, nil
+}
@@ -0,0 +1,361 @@
+// Package client is the Peril player: it joins the lobby, plays the
+// commands of its input and handles the moves and wars of other players.
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// AppID identifies the client in the envelope of every message it sends.
+const AppID = "peril-client"
+
+const (
+	warDedupCapacity = 1000
+	warDedupTTL      = time.Hour
+)
+
+// a move applied long after it was made no longer matches the board
+const armyMoveTTL = 10 * time.Second
+
+// blockedWait is how long handlers wait for a blocked broker to accept
+// their publish
+const blockedWait = 10 * time.Second
+
+// rateLimits keep a player within what the others accept from it, see
+// routing.GameLogRate.
+var rateLimits = map[string]pubsub.RateLimit{
+	routing.GameLogSlug:     {Rate: routing.GameLogRate, Burst: routing.GameLogBurst},
+	routing.ArmyMovesPrefix: {Rate: routing.ArmyMoveRate, Burst: routing.ArmyMoveBurst},
+}
+
+// outboxFlushTimeout is how long quit waits for moves still in the outbox
+const outboxFlushTimeout = 5 * time.Second
+
+// moveSendWait is how long the move command waits to report a move as
+// sent rather than queued.
+const moveSendWait = time.Second
+
+// Run plays the client against any broker with the commands read from
+// input, so the game can be driven by an in-memory broker as well as
+// RabbitMQ. It returns once the player quits or input ends.
+func Run(connection pubsub.Broker, input io.Reader, compression pubsub.Compression, outboxFile string) error {
+	// the REPL and the handlers publish concurrently. Publishes are
+	// confirmed, so handlers know whether their publish reached the broker
+	// to choose between Ack and NackRequeue
+	pool, err := pubsub.NewPublisherPool(connection, pubsub.DefaultPoolSize, false)
+	if err != nil {
+		return fmt.Errorf("could not open publisher channels: %w", err)
+	}
+	defer pool.Close()
+	// the client may start before the server has declared anything
+	topology, err := pubsub.ParseTopology(routing.TopologySpec)
+	if err != nil {
+		return err
+	}
+	if err := topology.Apply(connection); err != nil {
+		return fmt.Errorf("could not declare topology: %w", err)
+	}
+	table := pubsub.QueueOptions{DeadLetterExchange: routing.ExchangePerilDLX}.Table()
+	moveTable := pubsub.QueueOptions{DeadLetterExchange: routing.ExchangePerilDLX, MessageTTL: armyMoveTTL}.Table()
+	commands := gamelogic.NewInput(input)
+	username, err := commands.ClientWelcome()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Welcome %s! Nice to see you :)\n", username)
+	logger := slog.Default().With("username", username)
+	slog.SetDefault(logger)
+	pubsub.SetLogger(logger)
+	caller, err := pubsub.NewCaller(connection)
+	if err != nil {
+		return fmt.Errorf("could not open RPC caller: %w", err)
+	}
+	defer caller.Close()
+	gamestate := gamelogic.NewGameState(username)
+	joined, signer, err := join(caller, gamestate)
+	if err != nil {
+		return err
+	}
+	// leaving and fetching game keys are only answered for the verified
+	// player
+	caller.Sign(signer)
+	// moves and wars are signed by the player sending them, under a
+	// certificate of the server
+	players := pubsub.TrustedAuthority(joined.AuthorityKey)
+	gameKeys, err := gameKeyring(caller, username, joined)
+	if err != nil {
+		return err
+	}
+	encryption := pubsub.Encryption{Keys: gameKeys}
+	envelope := pubsub.Envelope{AppID: AppID, Sender: username}
+	seal := func(ch pubsub.Publisher) pubsub.Publisher {
+		return envelope.Publisher(compression.Publisher(encryption.Publisher(signer.Publisher(ch))))
+	}
+	flow := pubsub.WatchFlow(connection)
+	limiter := pubsub.NewRateLimiter(rateLimits)
+	// the REPL reports a blocked broker or a rate limit at once, handlers
+	// give it a while before requeueing
+	publisher := seal(limiter.Publisher(flow.Publisher(pool, 0), 0))
+	handlerPublisher := seal(limiter.Publisher(flow.Publisher(pool, blockedWait), blockedWait))
+	// heartbeats are signed but not encrypted, so servers handing out
+	// other game keys keep the session alive as well
+	announcer := envelope.Publisher(signer.Publisher(flow.Publisher(pool, 0)))
+	// a move is applied locally right away, so it has to reach the others
+	// even if the broker is away for a while
+	if outboxFile == "" {
+		outboxFile = fmt.Sprintf("peril-%s.outbox", username)
+	}
+	// moves left over from an earlier session are signed for it and moved
+	// units that no longer exist, so they are dropped
+	outbox, err := pubsub.NewOutbox(outboxFile, limiter.Publisher(flow.Publisher(pool, 0), 0), signer.Certificate.Session, reportDropped)
+	if err != nil {
+		return fmt.Errorf("could not open outbox: %w", err)
+	}
+	defer outbox.Close()
+	// moves beyond a player's quota are dead-lettered instead of played
+	quota := pubsub.NewQuota(rateLimits)
+	// a client that quit stops taking wars off the shared queue
+	var subs []*pubsub.Subscription
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), outboxFlushTimeout)
+		defer cancel()
+		for _, sub := range subs {
+			if err := sub.Close(ctx); err != nil {
+				slog.Warn("could not close subscription", "error", err)
+			}
+		}
+	}()
+	moves, err := pubsub.SubscribeWithMetadata(connection, routing.ExchangePerilTopic, strings.Join([]string{"army_moves", username}, "."), "army_moves.*", pubsub.Transient, handleMove(gamestate, handlerPublisher), pubsub.DecodeJSON, moveTable, pubsub.WithVerifier(players), pubsub.WithDecryption(gameKeys), pubsub.WithMiddleware(pubsub.Recover[gamelogic.ArmyMove](), pubsub.Enforce[gamelogic.ArmyMove](quota, pubsub.NackDiscard)))
+	if err != nil {
+		return fmt.Errorf("could not subscribe to army moves: %w", err)
+	}
+	subs = append(subs, moves)
+
+	// a war fought twice would remove units twice. Its log goes through
+	// the outbox, so a broker that is away cannot make the war requeue
+	// after it was fought. A war whose attacker left, or that keeps
+	// crashing its clients, is dead-lettered after
+	// pubsub.DefaultDeliveryLimit redeliveries
+	seenWars, err := pubsub.NewDedupStore(warDedupCapacity, warDedupTTL, "")
+	if err != nil {
+		return err
+	}
+	wars, err := pubsub.SubscribeWithMetadata(connection, routing.ExchangePerilTopic, "war", "war.*", pubsub.Quorum, handleWar(gamestate, seal(outbox)), pubsub.DecodeJSON, table, pubsub.WithDedup(seenWars), pubsub.WithVerifier(players), pubsub.WithDecryption(gameKeys), pubsub.WithMiddleware(pubsub.Recover[gamelogic.RecognitionOfWar]()))
+	if err != nil {
+		return fmt.Errorf("could not subscribe to wars: %w", err)
+	}
+	subs = append(subs, wars)
+
+	pauses, err := pubsub.Subscribe(connection, routing.ExchangePerilDirect,
+		fmt.Sprintf("%s.%s", "pause", username), routing.PauseKey, pubsub.Transient, handlerPause(gamestate), pubsub.DecodeJSON, table, pubsub.WithMiddleware(pubsub.Recover[routing.PlayingState]()))
+	if err != nil {
+		return fmt.Errorf("could not subscribe to pauses: %w", err)
+	}
+	subs = append(subs, pauses)
+
+	// the server frees the name of a player whose heartbeats stop
+	stopHeartbeat := make(chan struct{})
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		heartbeat(announcer, username, stopHeartbeat)
+	}()
+
+gameLoop:
+	for {
+		words, ok := commands.Next()
+		if !ok {
+			// e.g. ctrl+d, leave as if the player quit
+			words = []string{"quit"}
+		}
+		if len(words) == 0 {
+			continue
+		}
+
+		switch words[0] {
+		case "spawn":
+			err := gamestate.CommandSpawn(words)
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+		case "move":
+			before := gamestate.GetPlayerSnap()
+			var moved []gamelogic.Unit
+			err := outbox.Do(func(tx pubsub.Publisher) error {
+				armyMove, err := gamestate.CommandMove(words)
+				if err != nil {
+					return err
+				}
+				moved = armyMove.Units
+				return pubsub.PublishJSON(pubsub.MessageOptions{Expiration: armyMoveTTL}.Publisher(seal(tx)), routing.ExchangePerilTopic, strings.Join([]string{"army_moves", username}, "."), armyMove)
+			})
+			if err != nil {
+				// a move nobody will hear of is taken back
+				for _, unit := range moved {
+					if old, ok := before.Units[unit.ID]; ok {
+						gamestate.UpdateUnit(old)
+					}
+				}
+				fmt.Println("Ohh myy dear... Move wasn't pubslihed at all.", err)
+				break
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), moveSendWait)
+			err = outbox.Flush(ctx)
+			cancel()
+			if err == nil {
+				fmt.Println("Move was published successfully")
+			} else {
+				fmt.Printf("Move was queued, it is sent if the broker takes it within %s.\n", armyMoveTTL)
+			}
+		case "status":
+			gamelogic.PrintClientHelp()
+		case "players":
+			resp, err := pubsub.Call[routing.PlayersRequest, routing.PlayersResponse](context.Background(), caller, routing.ExchangePerilDirect, routing.PlayersKey, routing.PlayersRequest{})
+			if err != nil {
+				fmt.Printf("Could not ask who is online: %v\n", err)
+				break
+			}
+			fmt.Printf("Online: %s\n", strings.Join(resp.Players, ", "))
+		case "spam":
+			fmt.Println("Spamming not allowed yet!")
+			if len(words) > 1 {
+				num, _ := strconv.Atoi(words[1])
+				if err != nil {
+					fmt.Printf("Bad conversion string to int: %v\n", words[1])
+					break
+				}
+				for i := 0; i < num; i++ {
+					malLog := gamelogic.GetMaliciousLog()
+					logMsg := routing.GameLog{
+						CurrentTime: time.Now(),
+						Message:     malLog,
+						Username:    username,
+					}
+					if err := pubsub.PublishGob(publisher, routing.ExchangePerilTopic, fmt.Sprintf("game_logs.%s", username), logMsg); err != nil {
+						fmt.Printf("Could not send log %d: %v\n", i, err)
+						break
+					}
+					fmt.Printf("%d, mal msg sended\n", i)
+				}
+
+			}
+		case "quit":
+			close(stopHeartbeat)
+			<-heartbeatDone
+			// the leave request is only verified while the session is live,
+			// the other servers hear of it afterwards
+			_, err := pubsub.Call[routing.LeaveRequest, struct{}](context.Background(), caller, routing.ExchangePerilDirect, routing.LeaveKey, routing.LeaveRequest{Username: username})
+			if err != nil {
+				slog.Warn("could not leave the lobby", "error", err)
+			}
+			if err := publishPresence(announcer, username, true); err != nil {
+				slog.Warn("could not announce leaving", "error", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), outboxFlushTimeout)
+			if err := outbox.Flush(ctx); err != nil {
+				slog.Warn("quitting with moves not sent, they are sent on the next start", "error", err)
+			}
+			cancel()
+			gamelogic.PrintQuit()
+			break gameLoop
+		default:
+			fmt.Printf("I don't know what %s means\n", words[0])
+		}
+	}
+	fmt.Println("Closing the game")
+	return nil
+}
+
+// heartbeat announces the player every routing.HeartbeatInterval until
+// stop is closed.
+func heartbeat(ch pubsub.Publisher, username string, stop <-chan struct{}) {
+	ticker := time.NewTicker(routing.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if err := publishPresence(ch, username, false); err != nil {
+			slog.Warn("could not send heartbeat", "error", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func publishPresence(ch pubsub.Publisher, username string, leaving bool) error {
+	p := routing.Presence{Username: username, Leaving: leaving, SentAt: time.Now()}
+	return pubsub.PublishJSON(ch, routing.ExchangePerilTopic, strings.Join([]string{routing.PresencePrefix, username}, "."), p)
+}
+
+// reportDropped tells the player about a queued message that was never
+// sent. The move already happened here, so the other players' view of the
+// game differs from the player's until units move again.
+func reportDropped(d pubsub.OutboxDrop) {
+	what := "A message"
+	if strings.HasPrefix(d.Key, routing.ArmyMovesPrefix+".") {
+		what = "A move"
+	}
+	fmt.Printf("\n%s queued at %s was never sent (%v). The other players did not see it.\n> ", what, d.Stored.Format(time.TimeOnly), d.Reason)
+}
+
+// join asks the server to certify a fresh signing key for this session.
+// Without it nothing the client sends would be accepted, so failing to
+// join ends the client.
+func join(caller *pubsub.Caller, gs *gamelogic.GameState) (routing.JoinResponse, pubsub.Signer, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return routing.JoinResponse{}, pubsub.Signer{}, err
+	}
+	req := routing.JoinRequest{Username: gs.GetUsername(), PublicKey: public}
+	resp, err := pubsub.Call[routing.JoinRequest, routing.JoinResponse](context.Background(), caller, routing.ExchangePerilDirect, routing.JoinKey, req)
+	var remote *pubsub.RemoteError
+	if errors.As(err, &remote) {
+		return routing.JoinResponse{}, pubsub.Signer{}, errors.New(remote.Message)
+	}
+	if err != nil {
+		return routing.JoinResponse{}, pubsub.Signer{}, fmt.Errorf("could not join the lobby: %w", err)
+	}
+	cert, err := pubsub.ParseCertificate(resp.Certificate)
+	if err != nil {
+		return routing.JoinResponse{}, pubsub.Signer{}, err
+	}
+	if err := pubsub.TrustedAuthority(resp.AuthorityKey).VerifyCertificate(cert); err != nil {
+		return routing.JoinResponse{}, pubsub.Signer{}, err
+	}
+	fmt.Printf("Online: %s\n", strings.Join(resp.Players, ", "))
+	// the pause broadcast may have gone out before this client was listening
+	gs.HandlePause(routing.PlayingState{IsPaused: resp.IsPaused})
+	return resp, pubsub.Signer{Certificate: cert, Key: private}, nil
+}
+
+// gameKeyring encrypts with the game key handed out at join and asks the
+// server for keys it rotated in since.
+func gameKeyring(caller *pubsub.Caller, username string, joined routing.JoinResponse) (*pubsub.Keyring, error) {
+	keys := pubsub.NewKeyring()
+	if err := keys.Rotate(joined.GameKeyID, joined.GameKey); err != nil {
+		return nil, fmt.Errorf("invalid game key: %w", err)
+	}
+	keys.Fetch = func(id string) ([]byte, error) {
+		req := routing.GameKeyRequest{Username: username, KeyID: id}
+		resp, err := pubsub.Call[routing.GameKeyRequest, routing.GameKeyResponse](context.Background(), caller, routing.ExchangePerilDirect, routing.GameKeyKey, req)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Key, nil
+	}
+	return keys, nil
+}
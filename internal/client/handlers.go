@@ -0,0 +1,96 @@
+package client
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func handlerPause(gs *gamelogic.GameState) func(routing.PlayingState) pubsub.Acktype {
+	return func(rps routing.PlayingState) pubsub.Acktype {
+		defer fmt.Print("> ")
+		gs.HandlePause(rps)
+		return pubsub.Ack
+	}
+}
+
+func handleMove(gs *gamelogic.GameState, ch pubsub.Publisher) func(gamelogic.ArmyMove, pubsub.Metadata) pubsub.Acktype {
+	return func(am gamelogic.ArmyMove, meta pubsub.Metadata) pubsub.Acktype {
+		defer fmt.Print("> ")
+		// the signature vouches for the sender, not for the name in the body
+		if meta.Sender != am.Player.Username {
+			slog.Warn("discarded move made in another player's name", "sender", meta.Sender, "player", am.Player.Username)
+			return pubsub.NackDiscard
+		}
+		moveOutcome := gs.HandleMove(am)
+		if moveOutcome == gamelogic.MoveOutcomeMakeWar {
+			fmt.Printf("This dude: %s, attacked this dude: %s", gs.Player.Username, am.Player.Username)
+			rofMsg := gamelogic.RecognitionOfWar{
+				Attacker: am.Player,
+				Defender: gs.Player,
+			}
+			// Publish the JSON message
+			routingKey := strings.Join([]string{routing.WarRecognitionsPrefix, gs.Player.Username}, ".")
+			err := pubsub.PublishJSON(pubsub.CausedBy(ch, meta), routing.ExchangePerilTopic, routingKey, rofMsg)
+			if err != nil {
+				slog.Error("could not publish war recognition", "routing_key", routingKey, "error", err)
+				return pubsub.NackRequeue
+			}
+
+			return pubsub.Ack
+		}
+		if moveOutcome == gamelogic.MoveOutComeSafe {
+			return pubsub.Ack
+		} else if moveOutcome == gamelogic.MoveOutcomeSamePlayer {
+			return pubsub.NackDiscard
+		} else {
+			return pubsub.NackDiscard
+		}
+	}
+}
+
+// handleWar fights wars the player is attacked in and logs the outcome on
+// ch. A war is acked once fought, even if its log cannot be published.
+// Wars share one queue, so a war of other players is requeued for them.
+func handleWar(gs *gamelogic.GameState, ch pubsub.Publisher) func(gamelogic.RecognitionOfWar, pubsub.Metadata) pubsub.Acktype {
+	return func(rof gamelogic.RecognitionOfWar, meta pubsub.Metadata) pubsub.Acktype {
+		defer fmt.Print("> ")
+		// war is declared by the defender whose territory was entered
+		if meta.Sender != rof.Defender.Username {
+			slog.Warn("discarded war declared in another player's name", "sender", meta.Sender, "defender", rof.Defender.Username)
+			return pubsub.NackDiscard
+		}
+		outcome, winner, loser := gs.HandleWar(rof)
+		if outcome == gamelogic.WarOutcomeNotInvolved {
+			return pubsub.NackRequeue
+		}
+		var logs = routing.GameLog{
+			CurrentTime: time.Now(),
+			Message:     getLogs(outcome, winner, loser),
+			Username:    gs.GetUsername(),
+		}
+		username := gs.Player.Username
+		err := pubsub.PublishGob(pubsub.CausedBy(ch, meta), routing.ExchangePerilTopic, strings.Join([]string{routing.GameLogSlug, username}, "."), logs)
+		if err != nil {
+			// the war was fought, handling it again would fight it twice
+			slog.Error("could not publish game log", "message_id", meta.MessageID, "error", err)
+		}
+		return pubsub.Ack
+	}
+}
+
+func getLogs(warOutcome gamelogic.WarOutcome, winner, loser string) string {
+	switch warOutcome {
+	case gamelogic.WarOutcomeOpponentWon, gamelogic.WarOutcomeYouWon:
+		return fmt.Sprintf("%s won a war against %s", winner, loser)
+	case gamelogic.WarOutcomeDraw:
+		return fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser)
+	default:
+		return fmt.Sprint(warOutcome)
+	}
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newSigner(t *testing.T, authority *pubsub.Authority, username string) pubsub.Signer {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pubsub.Signer{Certificate: authority.Issue(username, pubsub.NewMessageID(), public), Key: private}
+}
+
+// deadLetters collects the messages a subscribed handler discarded.
+func deadLetters(t *testing.T, mem *pubsub.MemoryBroker) <-chan amqp.Delivery {
+	t.Helper()
+	if err := pubsub.DeclareDeadLetter(mem, routing.ExchangePerilDLX, routing.DeadLetterQueue); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := mem.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ch.Close() })
+	dead, err := ch.Consume(routing.DeadLetterQueue, "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dead
+}
+
+func TestSignedMessagesInAnotherPlayersNameAreDiscarded(t *testing.T) {
+	authority, err := pubsub.GenerateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory := newSigner(t, authority, "mallory")
+	mem := pubsub.NewMemoryBroker()
+	ch, _ := mem.Channel()
+	if err := ch.ExchangeDeclare(routing.ExchangePerilTopic, "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	dead := deadLetters(t, mem)
+	table := amqp.Table{"x-dead-letter-exchange": routing.ExchangePerilDLX}
+	trusted := pubsub.WithVerifier(pubsub.TrustedAuthority(authority.PublicKey()))
+	bob := gamelogic.NewGameState("bob")
+	if _, err := pubsub.SubscribeWithMetadata(mem, routing.ExchangePerilTopic, "army_moves.bob", "army_moves.*", pubsub.Transient, handleMove(bob, ch), pubsub.DecodeJSON, table, trusted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pubsub.SubscribeWithMetadata(mem, routing.ExchangePerilTopic, "war", "war.*", pubsub.Quorum, handleWar(bob, ch), pubsub.DecodeJSON, table, trusted); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := gamelogic.Player{Username: "alice", Units: map[int]gamelogic.Unit{}}
+	forgeries := []struct {
+		key string
+		val any
+	}{
+		{"army_moves.mallory", gamelogic.ArmyMove{Player: alice, ToLocation: "europe"}},
+		{"war.mallory", gamelogic.RecognitionOfWar{Attacker: bob.GetPlayerSnap(), Defender: alice}},
+	}
+	for _, f := range forgeries {
+		if err := pubsub.PublishJSON(mallory.Publisher(ch), routing.ExchangePerilTopic, f.key, f.val); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case d := <-dead:
+			if d.RoutingKey != f.key {
+				t.Fatalf("dead-lettered %s, want %s", d.RoutingKey, f.key)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s signed by mallory in alice's name was not discarded", f.key)
+		}
+	}
+}
+
+type failingPublisher struct {
+	calls int
+}
+
+func (p *failingPublisher) PublishWithContext(context.Context, string, string, bool, bool, amqp.Publishing) error {
+	p.calls++
+	return pubsub.ErrNotConnected
+}
+
+func TestWarIsAckedOnceFoughtEvenIfItsLogFails(t *testing.T) {
+	alice := gamelogic.NewGameState("alice")
+	if err := alice.CommandSpawn([]string{"spawn", "europe", "infantry"}); err != nil {
+		t.Fatal(err)
+	}
+	bob := gamelogic.NewGameState("bob")
+	if err := bob.CommandSpawn([]string{"spawn", "europe", "artillery"}); err != nil {
+		t.Fatal(err)
+	}
+	logs := &failingPublisher{}
+	rof := gamelogic.RecognitionOfWar{Attacker: alice.GetPlayerSnap(), Defender: bob.GetPlayerSnap()}
+	if ack := handleWar(alice, logs)(rof, pubsub.Metadata{Sender: "bob", Verified: true}); ack != pubsub.Ack {
+		t.Fatalf("war with an unpublished log = %v, want Ack so it is not fought again", ack)
+	}
+	if logs.calls != 1 {
+		t.Errorf("log published %d times", logs.calls)
+	}
+	if units := alice.GetPlayerSnap().Units; len(units) != 0 {
+		t.Errorf("alice lost the war but kept %v", units)
+	}
+}
+
+func TestWarOfOtherPlayersIsRequeued(t *testing.T) {
+	alice := gamelogic.NewGameState("alice")
+	bob := gamelogic.NewGameState("bob")
+	for _, gs := range []*gamelogic.GameState{alice, bob} {
+		if err := gs.CommandSpawn([]string{"spawn", "europe", "infantry"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logs := &failingPublisher{}
+	rof := gamelogic.RecognitionOfWar{Attacker: alice.GetPlayerSnap(), Defender: bob.GetPlayerSnap()}
+	// the defender declared the war, only the attacker fights it
+	if ack := handleWar(bob, logs)(rof, pubsub.Metadata{Sender: "bob", Verified: true}); ack != pubsub.NackRequeue {
+		t.Fatalf("war declared by the player = %v, want NackRequeue for the attacker", ack)
+	}
+	if logs.calls != 0 {
+		t.Errorf("war that was not fought logged %d times", logs.calls)
+	}
+	if units := bob.GetPlayerSnap().Units; len(units) != 1 {
+		t.Errorf("units of a war not fought changed: %v", units)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"strings"
@@ -26,9 +27,14 @@ func PrintClientHelp() {
 }
 
 func ClientWelcome() (string, error) {
+	return stdin.ClientWelcome()
+}
+
+// ClientWelcome asks the player for their username on in.
+func (in *Input) ClientWelcome() (string, error) {
 	fmt.Println("Welcome to the Peril client!")
 	fmt.Println("Please enter your username:")
-	words := GetInput()
+	words, _ := in.Next()
 	if len(words) == 0 {
 		return "", errors.New("you must enter a username. goodbye")
 	}
@@ -46,16 +52,32 @@ func PrintServerHelp() {
 	fmt.Println("* help")
 }
 
-func GetInput() []string {
+// Input reads a player's commands line by line, e.g. from os.Stdin.
+type Input struct {
+	scanner *bufio.Scanner
+}
+
+func NewInput(r io.Reader) *Input {
+	return &Input{scanner: bufio.NewScanner(r)}
+}
+
+// Next prompts for a line and returns its words. ok is false once the
+// input has ended.
+func (in *Input) Next() (words []string, ok bool) {
 	fmt.Print("> ")
-	scanner := bufio.NewScanner(os.Stdin)
-	scanned := scanner.Scan()
-	if !scanned {
-		return nil
+	if !in.scanner.Scan() {
+		return nil, false
 	}
-	line := scanner.Text()
-	line = strings.TrimSpace(line)
-	return strings.Fields(line)
+	return strings.Fields(in.scanner.Text()), true
+}
+
+// stdin is shared so lines buffered by one read are not lost to the next
+var stdin = NewInput(os.Stdin)
+
+// GetInput reads a line from os.Stdin, see Input.Next.
+func GetInput() []string {
+	words, _ := stdin.Next()
+	return words
 }
 
 func GetMaliciousLog() string {
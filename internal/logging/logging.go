@@ -0,0 +1,43 @@
+// Package logging builds the diagnostic logger shared by the Peril
+// commands. Diagnostics go to stderr so they stay out of the game text
+// players read on stdout.
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Flags are the logging command line flags.
+type Flags struct {
+	Format string
+	Level  string
+}
+
+// Register adds -log-format and -log-level to fs.
+func Register(fs *flag.FlagSet) *Flags {
+	f := &Flags{}
+	fs.StringVar(&f.Format, "log-format", "text", "log output format: text or json")
+	fs.StringVar(&f.Level, "log-level", "info", "minimum log level: debug, info, warn or error")
+	return f
+}
+
+// New returns a logger writing to w in the flags' format.
+func (f *Flags) New(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(f.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", f.Level)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(f.Format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, want text or json", f.Format)
+	}
+}
@@ -0,0 +1,337 @@
+// Package metrics keeps counters, gauges and histograms and exposes them
+// in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets suit latencies from milliseconds to several seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metric families in the order they were created.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+	names    map[string]bool
+}
+
+// Default is the registry pubsub records to.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) register(name string, f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.families = append(r.families, f)
+}
+
+// WriteTo writes every metric in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler serves the registry for Prometheus to scrape.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// vec is the set of series of one metric, one per combination of label
+// values.
+type vec[S any] struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	create func() S
+
+	mu     sync.RWMutex
+	series map[string]*labeled[S]
+}
+
+type labeled[S any] struct {
+	values []string
+	series S
+}
+
+func newVec[S any](name, help, kind string, labels []string, create func() S) *vec[S] {
+	return &vec[S]{name: name, help: help, kind: kind, labels: labels, create: create, series: map[string]*labeled[S]{}}
+}
+
+func (v *vec[S]) with(values []string) S {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	l, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return l.series
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if l, ok := v.series[key]; ok {
+		return l.series
+	}
+	l = &labeled[S]{values: append([]string(nil), values...), series: v.create()}
+	v.series[key] = l
+	return l.series
+}
+
+// sorted returns the series ordered by label values so scrapes are stable.
+func (v *vec[S]) sorted() []*labeled[S] {
+	v.mu.RLock()
+	out := make([]*labeled[S], 0, len(v.series))
+	for _, l := range v.series {
+		out = append(out, l)
+	}
+	v.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].values, out[j].values
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+	return out
+}
+
+func (v *vec[S]) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+}
+
+// value is a float64 updated atomically.
+type value struct {
+	bits atomic.Uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+type Counter struct {
+	v value
+}
+
+func (c *Counter) Inc() { c.v.add(1) }
+
+// Add panics on a negative delta, counters only go up.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.v.add(delta)
+}
+
+type CounterVec struct {
+	vec *vec[*Counter]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+	r.register(name, c)
+	return c
+}
+
+// With returns the counter for the label values, in the order the labels
+// were declared.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.vec.with(values)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.vec.header(w)
+	for _, l := range c.vec.sorted() {
+		writeSample(w, c.vec.name, c.vec.labels, l.values, "", "", l.series.v.get())
+	}
+}
+
+type Gauge struct {
+	v value
+}
+
+func (g *Gauge) Inc()              { g.v.add(1) }
+func (g *Gauge) Dec()              { g.v.add(-1) }
+func (g *Gauge) Add(delta float64) { g.v.add(delta) }
+func (g *Gauge) Set(val float64)   { g.v.bits.Store(math.Float64bits(val)) }
+
+type GaugeVec struct {
+	vec *vec[*Gauge]
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newVec(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+	r.register(name, g)
+	return g
+}
+
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.vec.with(values)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.vec.header(w)
+	for _, l := range g.vec.sorted() {
+		writeSample(w, g.vec.name, g.vec.labels, l.values, "", "", l.series.v.get())
+	}
+}
+
+type Histogram struct {
+	upper  []float64
+	counts []atomic.Uint64
+	sum    value
+	count  atomic.Uint64
+}
+
+func (h *Histogram) Observe(val float64) {
+	i := sort.SearchFloat64s(h.upper, val)
+	if i < len(h.upper) {
+		h.counts[i].Add(1)
+	}
+	h.sum.add(val)
+	h.count.Add(1)
+}
+
+type HistogramVec struct {
+	vec *vec[*Histogram]
+}
+
+// NewHistogramVec creates a histogram with the given upper bounds, which
+// have to be sorted. A nil buckets uses DefaultBuckets.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	create := func() *Histogram {
+		return &Histogram{upper: buckets, counts: make([]atomic.Uint64, len(buckets))}
+	}
+	h := &HistogramVec{vec: newVec(name, help, "histogram", labels, create)}
+	r.register(name, h)
+	return h
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.vec.with(values)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.vec.header(w)
+	for _, l := range h.vec.sorted() {
+		hist := l.series
+		var cumulative uint64
+		for i, upper := range hist.upper {
+			cumulative += hist.counts[i].Load()
+			writeSample(w, h.vec.name+"_bucket", h.vec.labels, l.values, "le", formatFloat(upper), float64(cumulative))
+		}
+		count := hist.count.Load()
+		writeSample(w, h.vec.name+"_bucket", h.vec.labels, l.values, "le", "+Inf", float64(count))
+		writeSample(w, h.vec.name+"_sum", h.vec.labels, l.values, "", "", hist.sum.get())
+		writeSample(w, h.vec.name+"_count", h.vec.labels, l.values, "", "", float64(count))
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, val float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabel(values[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(val))
+	w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+// ListenAndServe serves Default on addr under /metrics.
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default.Handler())
+	return http.ListenAndServe(addr, mux)
+}
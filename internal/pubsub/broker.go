@@ -0,0 +1,82 @@
+package pubsub
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Publisher sends messages to an exchange. *amqp.Channel satisfies it.
+type Publisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// Subscriber declares queues and consumes deliveries from them.
+// *amqp.Channel satisfies it.
+type Subscriber interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	NotifyCancel(c chan string) chan string
+}
+
+// Channel is the part of *amqp.Channel that pubsub relies on.
+type Channel interface {
+	Publisher
+	Subscriber
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// Broker hands out channels. Use Dial or NewAMQPBroker for RabbitMQ and
+// NewMemoryBroker for an in-process broker.
+type Broker interface {
+	Channel() (Channel, error)
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	// NotifyBlocked reports when the broker starts and stops blocking
+	// publishers on resource alarms. c must be drained.
+	NotifyBlocked(c chan amqp.Blocking) chan amqp.Blocking
+	Close() error
+}
+
+type amqpBroker struct {
+	conn *amqp.Connection
+}
+
+func NewAMQPBroker(conn *amqp.Connection) Broker {
+	return &amqpBroker{conn: conn}
+}
+
+func Dial(url string) (Broker, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewAMQPBroker(conn), nil
+}
+
+func (b *amqpBroker) Channel() (Channel, error) {
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (b *amqpBroker) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	return b.conn.NotifyClose(c)
+}
+
+func (b *amqpBroker) NotifyBlocked(c chan amqp.Blocking) chan amqp.Blocking {
+	return b.conn.NotifyBlocked(c)
+}
+
+func (b *amqpBroker) Close() error {
+	return b.conn.Close()
+}
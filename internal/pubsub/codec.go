@@ -0,0 +1,98 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sync"
+)
+
+// Codec turns values into message bodies for one content type.
+type Codec interface {
+	ContentType() string
+	Encode(v any) ([]byte, error)
+	// Decode decodes data into the value v points to.
+	Decode(data []byte, v any) error
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string             { return "application/json" }
+func (JSONCodec) Encode(v any) ([]byte, error)    { return json.Marshal(v) }
+func (JSONCodec) Decode(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type GobCodec struct{}
+
+func (GobCodec) ContentType() string { return "application/gob" }
+
+func (GobCodec) Encode(v any) ([]byte, error) {
+	var network bytes.Buffer
+	if err := gob.NewEncoder(&network).Encode(v); err != nil {
+		return nil, err
+	}
+	return network.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// MsgpackCodec is a compact, schemaless binary format. It is usually
+// several times smaller than gob for a single message because it carries no
+// type descriptions.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) ContentType() string             { return "application/msgpack" }
+func (MsgpackCodec) Encode(v any) ([]byte, error)    { return marshalMsgpack(v) }
+func (MsgpackCodec) Decode(data []byte, v any) error { return unmarshalMsgpack(data, v) }
+
+// CodecRegistry finds the codec for a message's content type.
+type CodecRegistry struct {
+	mu     sync.RWMutex
+	codecs map[string]Codec
+}
+
+// DefaultCodecs knows JSON, gob and MessagePack.
+var DefaultCodecs = NewCodecRegistry(JSONCodec{}, GobCodec{}, MsgpackCodec{})
+
+func NewCodecRegistry(codecs ...Codec) *CodecRegistry {
+	r := &CodecRegistry{codecs: map[string]Codec{}}
+	for _, c := range codecs {
+		r.Register(c)
+	}
+	return r
+}
+
+func (r *CodecRegistry) Register(c Codec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codecs[c.ContentType()] = c
+}
+
+// Lookup ignores content type parameters such as "; charset=utf-8".
+func (r *CodecRegistry) Lookup(contentType string) (Codec, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type %q: %w", contentType, err)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.codecs[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for content type %q", mediaType)
+	}
+	return c, nil
+}
+
+// Decode decodes data with the codec registered for contentType.
+func Decode[T any](r *CodecRegistry, contentType string, data []byte) (T, error) {
+	var v T
+	c, err := r.Lookup(contentType)
+	if err != nil {
+		return v, err
+	}
+	err = c.Decode(data, &v)
+	return v, err
+}
@@ -0,0 +1,194 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MaxDecompressedSize bounds how large a compressed body may grow, so a
+// small message cannot exhaust a consumer's memory.
+var MaxDecompressedSize int64 = 16 << 20
+
+// DefaultCompressionThreshold is the body size from which compressing
+// usually pays off.
+const DefaultCompressionThreshold = 1024
+
+// Compressor compresses bodies for one ContentEncoding.
+type Compressor interface {
+	Encoding() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// GzipCompressor compresses well and is understood everywhere.
+type GzipCompressor struct {
+	// Level is a compress/gzip level, zero means gzip.DefaultCompression.
+	Level int
+}
+
+func (GzipCompressor) Encoding() string { return "gzip" }
+
+func (c GzipCompressor) Compress(data []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r)
+}
+
+// DeflateCompressor is the "deflate" encoding (zlib format). At
+// zlib.BestSpeed it trades some ratio for much cheaper compression, which
+// suits bursts of small messages. The standard library has no zstd; a
+// zstd Compressor can be added with RegisterCompressor.
+type DeflateCompressor struct {
+	// Level is a compress/zlib level, zero means zlib.BestSpeed.
+	Level int
+}
+
+func (DeflateCompressor) Encoding() string { return "deflate" }
+
+func (c DeflateCompressor) Compress(data []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = zlib.BestSpeed
+	}
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (DeflateCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r)
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > MaxDecompressedSize {
+		return nil, fmt.Errorf("decompressed body exceeds %d bytes", MaxDecompressedSize)
+	}
+	return data, nil
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{}
+)
+
+func init() {
+	RegisterCompressor(GzipCompressor{})
+	RegisterCompressor(DeflateCompressor{})
+}
+
+// RegisterCompressor makes consumers able to read c's encoding.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.Encoding()] = c
+}
+
+// LookupCompressor finds the compressor for a ContentEncoding.
+func LookupCompressor(encoding string) (Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	return c, nil
+}
+
+// Decompress returns msg with its body decoded from its ContentEncoding.
+// Messages without an encoding are returned as they are.
+func Decompress(msg amqp.Delivery) (amqp.Delivery, error) {
+	if msg.ContentEncoding == "" {
+		return msg, nil
+	}
+	c, err := LookupCompressor(msg.ContentEncoding)
+	if err != nil {
+		return msg, err
+	}
+	body, err := c.Decompress(msg.Body)
+	if err != nil {
+		return msg, fmt.Errorf("could not decompress %s body: %w", msg.ContentEncoding, err)
+	}
+	msg.Body = body
+	msg.ContentEncoding = ""
+	return msg, nil
+}
+
+// Compression compresses bodies of at least Threshold bytes published
+// through its Publisher and marks them with the ContentEncoding consumers
+// decompress by. Messages that already have an encoding are left alone.
+type Compression struct {
+	Compressor Compressor
+	Threshold  int
+}
+
+func (c Compression) Publisher(ch Publisher) Publisher {
+	return &compressingPublisher{wrapper: wrapper{ch}, compression: c}
+}
+
+type compressingPublisher struct {
+	wrapper
+	compression Compression
+}
+
+func (p *compressingPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c := p.compression
+	if c.Compressor != nil && msg.ContentEncoding == "" && len(msg.Body) >= c.Threshold {
+		body, err := c.Compressor.Compress(msg.Body)
+		if err != nil {
+			return fmt.Errorf("could not compress message: %w", err)
+		}
+		// incompressible bodies are sent as they are
+		if len(body) < len(msg.Body) {
+			msg.Body = body
+			msg.ContentEncoding = c.Compressor.Encoding()
+		}
+	}
+	return p.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
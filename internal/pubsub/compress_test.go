@@ -0,0 +1,87 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	body := []byte(strings.Repeat("army_moves.washington infantry europe ", 100))
+	for _, c := range []Compressor{GzipCompressor{}, DeflateCompressor{}} {
+		target := &recordingPublisher{}
+		pub := Compression{Compressor: c, Threshold: DefaultCompressionThreshold}.Publisher(target)
+		if err := pub.PublishWithContext(context.Background(), "x", "k.a", false, false, amqp.Publishing{Body: body}); err != nil {
+			t.Fatal(err)
+		}
+		sent := target.msgs[0]
+		if sent.ContentEncoding != c.Encoding() || len(sent.Body) >= len(body) {
+			t.Errorf("%s: sent %d bytes as %q", c.Encoding(), len(sent.Body), sent.ContentEncoding)
+		}
+		got, err := Decompress(amqp.Delivery{ContentEncoding: sent.ContentEncoding, Body: sent.Body})
+		if err != nil {
+			t.Fatalf("%s: %v", c.Encoding(), err)
+		}
+		if !bytes.Equal(got.Body, body) || got.ContentEncoding != "" {
+			t.Errorf("%s: body did not round trip", c.Encoding())
+		}
+	}
+}
+
+func TestCompressionLeavesSmallBodies(t *testing.T) {
+	target := &recordingPublisher{}
+	pub := Compression{Compressor: GzipCompressor{}, Threshold: DefaultCompressionThreshold}.Publisher(target)
+	small := bytes.Repeat([]byte("a"), DefaultCompressionThreshold-1)
+	if err := pub.PublishWithContext(context.Background(), "x", "k.a", false, false, amqp.Publishing{Body: small}); err != nil {
+		t.Fatal(err)
+	}
+	if sent := target.msgs[0]; sent.ContentEncoding != "" || !bytes.Equal(sent.Body, small) {
+		t.Errorf("body below the threshold was sent as %q", sent.ContentEncoding)
+	}
+}
+
+func TestDecompressRejectsUnknownEncoding(t *testing.T) {
+	if _, err := Decompress(amqp.Delivery{ContentEncoding: "br", Body: []byte("x")}); err == nil {
+		t.Fatal("decompressed an unknown encoding")
+	}
+}
+
+func TestUnknownEncodingIsDiscarded(t *testing.T) {
+	mem := newTopicBroker(t)
+	handled := make(chan string, 2)
+	sub, err := Subscribe(mem, "x", "q", "k.*", Durable, func(s string) Acktype {
+		handled <- s
+		return Ack
+	}, DecodeJSON[string], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSub(t, sub)
+	publishRaw(t, mem, "x", "k.a", amqp.Publishing{ContentEncoding: "br", Body: []byte(`"br"`)})
+	publishRaw(t, mem, "x", "k.a", amqp.Publishing{Body: []byte(`"plain"`)})
+	select {
+	case s := <-handled:
+		if s != "plain" {
+			t.Fatalf("handled %q with an unknown encoding", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not handled")
+	}
+}
+
+func TestDecompressLimitsSize(t *testing.T) {
+	saved := MaxDecompressedSize
+	MaxDecompressedSize = 100
+	defer func() { MaxDecompressedSize = saved }()
+	body, err := GzipCompressor{}.Compress(make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decompress(amqp.Delivery{ContentEncoding: "gzip", Body: body}); err == nil {
+		t.Fatal("decompressed past MaxDecompressedSize")
+	}
+}
@@ -0,0 +1,113 @@
+package pubsub
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// otherShard finds a routing key handled by another worker than key.
+func otherShard(key string, workers int) string {
+	shard := func(k string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte(k))
+		return h.Sum32() % uint32(workers)
+	}
+	for i := 0; ; i++ {
+		other := fmt.Sprintf("k.%d", i)
+		if shard(other) != shard(key) {
+			return other
+		}
+	}
+}
+
+func TestKeyOrderingKeepsOrderPerKeyAndRunsKeysInParallel(t *testing.T) {
+	const workers = 4
+	mem := newTopicBroker(t)
+	release := make(chan struct{})
+	otherDone := make(chan struct{})
+	var mu sync.Mutex
+	var slow []int
+	handledAll := make(chan struct{})
+
+	other := otherShard("k.slow", workers)
+	sub, err := SubscribeWithMetadata(mem, "x", "q", "k.*", Durable, func(n int, meta Metadata) Acktype {
+		if meta.RoutingKey == other {
+			close(otherDone)
+			return Ack
+		}
+		if n == 1 {
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		slow = append(slow, n)
+		if len(slow) == 5 {
+			close(handledAll)
+		}
+		return Ack
+	}, DecodeJSON[int], nil, WithConcurrency(workers), WithKeyOrdering())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSub(t, sub)
+
+	publishRaw(t, mem, "x", "k.slow", amqp.Publishing{Body: []byte("1")})
+	publishRaw(t, mem, "x", other, amqp.Publishing{Body: []byte("0")})
+	for n := 2; n <= 5; n++ {
+		publishRaw(t, mem, "x", "k.slow", amqp.Publishing{Body: []byte(fmt.Sprint(n))})
+	}
+
+	select {
+	case <-otherDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("another key waited for the slow one")
+	}
+	close(release)
+	select {
+	case <-handledAll:
+	case <-time.After(2 * time.Second):
+		t.Fatal("slow key was not handled")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(slow, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("same key handled in order %v", slow)
+	}
+}
+
+func TestConcurrencyRunsHandlersInParallel(t *testing.T) {
+	const workers = 3
+	mem := newTopicBroker(t)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	all := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(all)
+	}()
+	sub, err := Subscribe(mem, "x", "q", "k.*", Durable, func(int) Acktype {
+		wg.Done()
+		// every handler waits for the others, so this only finishes if
+		// they all run at once
+		<-all
+		return Ack
+	}, DecodeJSON[int], nil, WithConcurrency(workers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSub(t, sub)
+	for n := 0; n < workers; n++ {
+		publishRaw(t, mem, "x", "k.a", amqp.Publishing{Body: []byte(fmt.Sprint(n))})
+	}
+	select {
+	case <-all:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handlers did not run concurrently")
+	}
+}
@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ConfirmTimeout bounds how long a ConfirmedPublisher waits for the broker
+// when the caller's context has no deadline.
+var ConfirmTimeout = 5 * time.Second
+
+var ErrNacked = errors.New("pubsub: message was nacked by the broker")
+
+// ReturnedError reports a mandatory message the broker could not route.
+type ReturnedError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *ReturnedError) Error() string {
+	return fmt.Sprintf("pubsub: message to %s/%s was returned: %d %s", e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+// ConfirmedPublisher is a Publisher that puts its channel in confirm mode
+// and only returns once the broker has taken responsibility for the
+// message, so handlers can decide between Ack and NackRequeue on a real
+// result. Publishes are serialized on one channel.
+type ConfirmedPublisher struct {
+	conn      Broker
+	mandatory bool
+
+	mu       sync.Mutex
+	ch       Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	seq      uint64
+}
+
+// NewConfirmedPublisher opens a confirm-mode channel on conn. With
+// mandatory set, every publish must reach at least one queue or it fails
+// with a *ReturnedError.
+func NewConfirmedPublisher(conn Broker, mandatory bool) (*ConfirmedPublisher, error) {
+	p := &ConfirmedPublisher{conn: conn, mandatory: mandatory}
+	if err := p.open(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *ConfirmedPublisher) open() error {
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return fmt.Errorf("could not put channel in confirm mode: %w", err)
+	}
+	p.ch = ch
+	p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	p.seq = 0
+	return nil
+}
+
+func (p *ConfirmedPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ConfirmTimeout)
+		defer cancel()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ch == nil {
+		if err := p.open(); err != nil {
+			return err
+		}
+	}
+
+	// forget returns left over from publishes that timed out
+	for len(p.returns) > 0 {
+		<-p.returns
+	}
+
+	err := p.ch.PublishWithContext(ctx, exchange, key, mandatory || p.mandatory, immediate, msg)
+	if err != nil {
+		p.discard()
+		return err
+	}
+	p.seq++
+
+	for {
+		select {
+		case conf, ok := <-p.confirms:
+			if !ok {
+				p.discard()
+				return amqp.ErrClosed
+			}
+			if conf.DeliveryTag < p.seq {
+				// confirm for an earlier publish that timed out
+				continue
+			}
+			if !conf.Ack {
+				return ErrNacked
+			}
+			select {
+			case ret := <-p.returns:
+				return &ReturnedError{
+					Exchange:   ret.Exchange,
+					RoutingKey: ret.RoutingKey,
+					ReplyCode:  ret.ReplyCode,
+					ReplyText:  ret.ReplyText,
+				}
+			default:
+				return nil
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for publisher confirm: %w", ctx.Err())
+		}
+	}
+}
+
+// discard drops a channel that failed so the next publish opens a new one.
+func (p *ConfirmedPublisher) discard() {
+	p.ch.Close()
+	p.ch = nil
+}
+
+func (p *ConfirmedPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ch == nil {
+		return nil
+	}
+	err := p.ch.Close()
+	p.ch = nil
+	return err
+}
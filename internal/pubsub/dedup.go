@@ -0,0 +1,235 @@
+package pubsub
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ClaimStatus int
+
+const (
+	// Claimed means the message is new and the caller should handle it.
+	Claimed ClaimStatus = iota
+	// AlreadyProcessed means the message was handled before.
+	AlreadyProcessed
+	// InProgress means another worker is handling the same message now.
+	InProgress
+)
+
+// DedupStore remembers which message IDs have been processed.
+type DedupStore interface {
+	Claim(id string) ClaimStatus
+	// Release ends a claim. A processed message is remembered, otherwise
+	// it can be claimed again when it is redelivered.
+	Release(id string, processed bool) error
+}
+
+// DedupStats counts what an idempotent subscription did.
+type DedupStats struct {
+	Processed  int64
+	Duplicates int64
+}
+
+// MemoryDedupStore keeps the most recently processed IDs, up to a capacity
+// and for at most a TTL each. Given a path it also appends them to that
+// file and reloads them on start, so duplicates are caught across restarts.
+type MemoryDedupStore struct {
+	capacity int
+	ttl      time.Duration
+	path     string
+
+	mu       sync.Mutex
+	order    *list.List
+	entries  map[string]*list.Element
+	inFlight map[string]bool
+	file     *os.File
+	written  int
+	stats    DedupStats
+	closed   bool
+}
+
+type dedupEntry struct {
+	id      string
+	expires time.Time
+}
+
+// NewDedupStore creates a store remembering up to capacity IDs for ttl.
+// An empty path keeps it in memory only.
+func NewDedupStore(capacity int, ttl time.Duration, path string) (*MemoryDedupStore, error) {
+	s := &MemoryDedupStore{
+		capacity: capacity,
+		ttl:      ttl,
+		path:     path,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+		inFlight: map[string]bool{},
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *MemoryDedupStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not open dedup file: %v", err)
+	}
+	defer f.Close()
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		expiry, id, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		nanos, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil {
+			continue
+		}
+		expires := time.Unix(0, nanos)
+		if expires.After(now) {
+			s.remember(id, expires)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the file with only the IDs still remembered. If it
+// fails the old file stays in use, or none if it was already replaced, in
+// which case the next Release tries again.
+func (s *MemoryDedupStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write dedup file: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(dedupEntry)
+		fmt.Fprintf(w, "%d %s\n", entry.expires.UnixNano(), entry.id)
+	}
+	err = w.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not write dedup file: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not replace dedup file: %v", err)
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		s.file = nil
+		return fmt.Errorf("could not open dedup file: %v", err)
+	}
+	s.written = s.order.Len()
+	return nil
+}
+
+func (s *MemoryDedupStore) remember(id string, expires time.Time) {
+	if e, ok := s.entries[id]; ok {
+		s.order.Remove(e)
+	}
+	s.entries[id] = s.order.PushBack(dedupEntry{id: id, expires: expires})
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Front()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(dedupEntry).id)
+	}
+}
+
+func (s *MemoryDedupStore) Claim(id string) ClaimStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[id]; ok {
+		if time.Now().Before(e.Value.(dedupEntry).expires) {
+			s.stats.Duplicates++
+			return AlreadyProcessed
+		}
+		s.order.Remove(e)
+		delete(s.entries, id)
+	}
+	if s.inFlight[id] {
+		return InProgress
+	}
+	s.inFlight[id] = true
+	return Claimed
+}
+
+func (s *MemoryDedupStore) Release(id string, processed bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, id)
+	if !processed {
+		return nil
+	}
+	s.stats.Processed++
+	expires := time.Now().Add(s.ttl)
+	s.remember(id, expires)
+	if s.path == "" || s.closed {
+		return nil
+	}
+	if s.file == nil {
+		// an earlier compact failed, the rewrite includes id
+		return s.compact()
+	}
+	if _, err := fmt.Fprintf(s.file, "%d %s\n", expires.UnixNano(), id); err != nil {
+		return fmt.Errorf("could not write dedup file: %v", err)
+	}
+	s.written++
+	// forgotten IDs pile up in the file, rewrite it now and then
+	if s.written > 2*s.capacity {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *MemoryDedupStore) Stats() DedupStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+func (s *MemoryDedupStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// WithDedup skips messages whose MessageId the store has already seen,
+// acking them without calling the handler. Messages without an ID are
+// always handled.
+func WithDedup(store DedupStore) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.dedup = store
+	}
+}
@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeclareDeadLetter declares a fanout dead-letter exchange and a durable
+// queue collecting everything dead-lettered to it. Queues opt in with the
+// "x-dead-letter-exchange" argument.
+func DeclareDeadLetter(conn Broker, exchange, queue string) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err := ch.ExchangeDeclare(exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("could not declare dead-letter exchange %s: %w", exchange, err)
+	}
+	if _, err := ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("could not declare dead-letter queue %s: %w", queue, err)
+	}
+	if err := ch.QueueBind(queue, "", exchange, false, nil); err != nil {
+		return fmt.Errorf("could not bind dead-letter queue %s: %w", queue, err)
+	}
+	return nil
+}
+
+// DeadLetter describes why and from where a message was dead-lettered,
+// taken from the most recent entry of its x-death header.
+type DeadLetter struct {
+	Delivery   amqp.Delivery
+	Reason     string
+	Queue      string
+	Exchange   string
+	RoutingKey string
+	Count      int64
+	Time       time.Time
+}
+
+func NewDeadLetter(d amqp.Delivery) DeadLetter {
+	dl := DeadLetter{Delivery: d}
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return dl
+	}
+	death, _ := deaths[0].(amqp.Table)
+	dl.Reason, _ = death["reason"].(string)
+	dl.Queue, _ = death["queue"].(string)
+	dl.Exchange, _ = death["exchange"].(string)
+	dl.Count, _ = intArg(death, "count")
+	dl.Time, _ = death["time"].(time.Time)
+	if keys, ok := death["routing-keys"].([]interface{}); ok && len(keys) > 0 {
+		dl.RoutingKey, _ = keys[0].(string)
+	}
+	return dl
+}
+
+// PeekDeadLetters fetches the messages currently waiting in a dead-letter
+// queue declared by DeclareDeadLetter. They stay unacknowledged on the
+// returned channel: ack the ones that were handled, closing the channel
+// puts the rest back.
+func PeekDeadLetters(conn Broker, queue string, timeout time.Duration) (Channel, []DeadLetter, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, nil, err
+	}
+	q, err := ch.QueueDeclare(queue, true, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, nil, err
+	}
+	deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, nil, err
+	}
+
+	letters := []DeadLetter{}
+	deadline := time.After(timeout)
+	for len(letters) < q.Messages {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				return ch, letters, nil
+			}
+			letters = append(letters, NewDeadLetter(d))
+		case <-deadline:
+			return ch, letters, nil
+		}
+	}
+	return ch, letters, nil
+}
+
+// Replay publishes a dead-lettered message back to the exchange and routing
+// key it was dead-lettered from and acks it in the dead-letter queue.
+func (dl DeadLetter) Replay(ch Publisher) error {
+	if dl.Reason == "" {
+		return fmt.Errorf("message has no x-death header, nowhere to replay it to")
+	}
+	err := ch.PublishWithContext(context.Background(), dl.Exchange, dl.RoutingKey, false, false, publishingFromDelivery(dl.Delivery))
+	if err != nil {
+		return err
+	}
+	return dl.Delivery.Ack(false)
+}
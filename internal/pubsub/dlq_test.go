@@ -0,0 +1,75 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestPeekAndReplayDeadLetters(t *testing.T) {
+	mem := newTopicBroker(t)
+	if err := DeclareDeadLetter(mem, "dlx", "dead"); err != nil {
+		t.Fatal(err)
+	}
+	ch, _ := mem.Channel()
+	defer ch.Close()
+	if _, err := ch.QueueDeclare("q", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "dlx"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("q", "k.*", "x", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := ch.Consume("q", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishRaw(t, mem, "x", "k.a", amqp.Publishing{Body: []byte("m")})
+	if err := receive(t, deliveries).Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	peek, letters, err := PeekDeadLetters(mem, "dead", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("peeked %d dead letters, want 1", len(letters))
+	}
+	dl := letters[0]
+	if dl.Reason != "rejected" || dl.Queue != "q" || dl.RoutingKey != "k.a" {
+		t.Fatalf("dead letter = %+v", dl)
+	}
+	if err := dl.Replay(peek); err != nil {
+		t.Fatal(err)
+	}
+	peek.Close()
+
+	if again := receive(t, deliveries); string(again.Body) != "m" || again.RoutingKey != "k.a" {
+		t.Fatalf("replayed %q to %s", again.Body, again.RoutingKey)
+	}
+	if n := queueLength(t, mem, "dead"); n != 0 {
+		t.Errorf("%d messages left in the dead-letter queue after replay", n)
+	}
+}
+
+func TestPeekDeadLettersLeavesThemQueued(t *testing.T) {
+	mem := newTopicBroker(t)
+	if err := DeclareDeadLetter(mem, "dlx", "dead"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"k.a", "k.b"} {
+		publishRaw(t, mem, "dlx", key, amqp.Publishing{})
+	}
+	peek, letters, err := PeekDeadLetters(mem, "dead", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("peeked %d dead letters, want 2", len(letters))
+	}
+	peek.Close()
+	if n := queueLength(t, mem, "dead"); n != 2 {
+		t.Errorf("%d messages in the dead-letter queue after peeking, want 2", n)
+	}
+}
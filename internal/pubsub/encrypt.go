@@ -0,0 +1,208 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// EncryptionHeader names the cipher of an encrypted body.
+	EncryptionHeader = "x-encryption"
+	// KeyIDHeader names the key an encrypted body was sealed with.
+	KeyIDHeader = "x-key-id"
+)
+
+const encryptionAESGCM = "aes-gcm"
+
+var ErrNoDecryptionKey = errors.New("pubsub: no key to decrypt message")
+
+// DecryptionKeys finds keys by ID.
+type DecryptionKeys interface {
+	Key(id string) ([]byte, bool)
+}
+
+// Keyring holds AES keys by ID. New messages are sealed with the current
+// key, older keys stay around so messages sealed before a rotation can
+// still be opened.
+type Keyring struct {
+	// Fetch, if set, is asked for keys the keyring does not know yet,
+	// e.g. ones rotated in by another process.
+	Fetch func(id string) ([]byte, error)
+
+	mu      sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[string][]byte{}}
+}
+
+// GenerateKey returns a random AES-256 key and an ID for it.
+func GenerateKey() (id string, key []byte, err error) {
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", nil, err
+	}
+	var idBytes [8]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(idBytes[:]), key, nil
+}
+
+// Add makes key available for decryption.
+func (k *Keyring) Add(id string, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("invalid key %s: %w", id, err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = key
+	return nil
+}
+
+// Rotate adds key and seals new messages with it from now on.
+func (k *Keyring) Rotate(id string, key []byte) error {
+	if err := k.Add(id, key); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.current = id
+	return nil
+}
+
+// Current is the key new messages are sealed with.
+func (k *Keyring) Current() (string, []byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[k.current]
+	return k.current, key, ok
+}
+
+func (k *Keyring) Key(id string) ([]byte, bool) {
+	k.mu.RLock()
+	key, ok := k.keys[id]
+	fetch := k.Fetch
+	k.mu.RUnlock()
+	if ok || fetch == nil {
+		return key, ok
+	}
+	key, err := fetch(id)
+	if err != nil {
+		Logger().Warn("could not fetch key", "key_id", id, "error", err)
+		return nil, false
+	}
+	if err := k.Add(id, key); err != nil {
+		Logger().Warn("fetched key is invalid", "key_id", id, "error", err)
+		return nil, false
+	}
+	return key, true
+}
+
+// Encryption seals bodies published through its Publisher with AES-GCM
+// under the keyring's current key, so only holders of the key can read
+// them. Routing keys and headers stay readable for the broker. Without a
+// current key messages are sent in the clear.
+//
+// The key is symmetric and shared by everyone who may read the traffic.
+// It keeps bodies from the broker, its operators and anyone reading its
+// queues or disks without the key, but not from one key holder to
+// another: any holder can read, and seal, every message under it. Pair it
+// with signing to tell senders apart.
+type Encryption struct {
+	Keys *Keyring
+}
+
+func (e Encryption) Publisher(ch Publisher) Publisher {
+	return &encryptingPublisher{wrapper: wrapper{ch}, keys: e.Keys}
+}
+
+type encryptingPublisher struct {
+	wrapper
+	keys *Keyring
+}
+
+func (p *encryptingPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if p.keys == nil {
+		return p.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	}
+	id, secret, ok := p.keys.Current()
+	if !ok {
+		return p.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	}
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	// the message ID as additional data stops a body from being replayed
+	// under another message
+	msg.Body = gcm.Seal(nonce, nonce, msg.Body, []byte(msg.MessageId))
+	msg.Headers = copyTable(msg.Headers)
+	msg.Headers[EncryptionHeader] = encryptionAESGCM
+	msg.Headers[KeyIDHeader] = id
+	return p.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Decrypt returns msg with its body opened. Messages that are not
+// encrypted are returned as they are.
+func Decrypt(msg amqp.Delivery, keys DecryptionKeys) (amqp.Delivery, error) {
+	scheme, _ := msg.Headers[EncryptionHeader].(string)
+	if scheme == "" {
+		return msg, nil
+	}
+	if scheme != encryptionAESGCM {
+		return msg, fmt.Errorf("unsupported encryption %q", scheme)
+	}
+	id, _ := msg.Headers[KeyIDHeader].(string)
+	if keys == nil {
+		return msg, fmt.Errorf("%w %s", ErrNoDecryptionKey, id)
+	}
+	key, ok := keys.Key(id)
+	if !ok {
+		return msg, fmt.Errorf("%w %s", ErrNoDecryptionKey, id)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return msg, err
+	}
+	if len(msg.Body) < gcm.NonceSize() {
+		return msg, errors.New("encrypted body is too short")
+	}
+	nonce, sealed := msg.Body[:gcm.NonceSize()], msg.Body[gcm.NonceSize():]
+	body, err := gcm.Open(nil, nonce, sealed, []byte(msg.MessageId))
+	if err != nil {
+		return msg, fmt.Errorf("could not decrypt message with key %s: %w", id, err)
+	}
+	msg.Body = body
+	return msg, nil
+}
+
+// WithDecryption opens encrypted messages with keys before they are
+// decoded. Encrypted messages a subscription has no key for are discarded.
+func WithDecryption(keys DecryptionKeys) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.decryption = keys
+	}
+}
@@ -0,0 +1,138 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newKey(t *testing.T) (string, []byte) {
+	t.Helper()
+	id, key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, key
+}
+
+// sealed publishes body through Encryption with keys and returns what
+// the broker would deliver.
+func sealed(t *testing.T, keys *Keyring, id string, body []byte) amqp.Delivery {
+	t.Helper()
+	target := &recordingPublisher{}
+	msg := amqp.Publishing{MessageId: id, Body: body}
+	if err := (Encryption{Keys: keys}).Publisher(target).PublishWithContext(context.Background(), "x", "k.a", false, false, msg); err != nil {
+		t.Fatal(err)
+	}
+	sent := target.msgs[0]
+	return amqp.Delivery{MessageId: sent.MessageId, Headers: sent.Headers, Body: sent.Body}
+}
+
+func TestKeyringRotationKeepsOldKeys(t *testing.T) {
+	keys := NewKeyring()
+	oldID, oldKey := newKey(t)
+	if err := keys.Rotate(oldID, oldKey); err != nil {
+		t.Fatal(err)
+	}
+	before := sealed(t, keys, "m1", []byte("move"))
+	newID, newKey := newKey(t)
+	if err := keys.Rotate(newID, newKey); err != nil {
+		t.Fatal(err)
+	}
+	after := sealed(t, keys, "m2", []byte("move"))
+
+	if before.Headers[KeyIDHeader] != oldID || after.Headers[KeyIDHeader] != newID {
+		t.Fatalf("sealed with %v then %v, want %s then %s", before.Headers[KeyIDHeader], after.Headers[KeyIDHeader], oldID, newID)
+	}
+	if bytes.Contains(after.Body, []byte("move")) {
+		t.Fatal("body was sent in the clear")
+	}
+	for _, d := range []amqp.Delivery{before, after} {
+		opened, err := Decrypt(d, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(opened.Body) != "move" {
+			t.Errorf("opened %q", opened.Body)
+		}
+	}
+	if err := keys.Add("short", []byte("not an AES key")); err == nil {
+		t.Error("keyring took an invalid key")
+	}
+}
+
+func TestKeyringFetchesUnknownKeys(t *testing.T) {
+	id, key := newKey(t)
+	sender := NewKeyring()
+	if err := sender.Rotate(id, key); err != nil {
+		t.Fatal(err)
+	}
+	d := sealed(t, sender, "m1", []byte("move"))
+
+	fetches := 0
+	receiver := NewKeyring()
+	receiver.Fetch = func(want string) ([]byte, error) {
+		fetches++
+		if want != id {
+			return nil, errors.New("no such key")
+		}
+		return key, nil
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := Decrypt(d, receiver); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("fetched the key %d times, want once", fetches)
+	}
+	d.Headers = copyTable(d.Headers)
+	d.Headers[KeyIDHeader] = "unknown"
+	if _, err := Decrypt(d, receiver); !errors.Is(err, ErrNoDecryptionKey) {
+		t.Errorf("decrypt with a key that cannot be fetched = %v, want ErrNoDecryptionKey", err)
+	}
+}
+
+func TestDecryptRejectsUnknownKeyID(t *testing.T) {
+	id, key := newKey(t)
+	keys := NewKeyring()
+	if err := keys.Rotate(id, key); err != nil {
+		t.Fatal(err)
+	}
+	d := sealed(t, keys, "m1", []byte("move"))
+	if _, err := Decrypt(d, NewKeyring()); !errors.Is(err, ErrNoDecryptionKey) {
+		t.Errorf("decrypt without the key = %v, want ErrNoDecryptionKey", err)
+	}
+	if _, err := Decrypt(d, nil); !errors.Is(err, ErrNoDecryptionKey) {
+		t.Errorf("decrypt without a keyring = %v, want ErrNoDecryptionKey", err)
+	}
+}
+
+func TestDecryptRejectsTamperedMessages(t *testing.T) {
+	id, key := newKey(t)
+	keys := NewKeyring()
+	if err := keys.Rotate(id, key); err != nil {
+		t.Fatal(err)
+	}
+	d := sealed(t, keys, "m1", []byte("move"))
+
+	flipped := d
+	flipped.Body = bytes.Clone(d.Body)
+	flipped.Body[len(flipped.Body)-1] ^= 1
+	if _, err := Decrypt(flipped, keys); err == nil {
+		t.Error("tampered ciphertext decrypted")
+	}
+	replayed := d
+	replayed.MessageId = "m2"
+	if _, err := Decrypt(replayed, keys); err == nil {
+		t.Error("body decrypted under another message ID")
+	}
+	short := d
+	short.Body = d.Body[:4]
+	if _, err := Decrypt(short, keys); err == nil {
+		t.Error("truncated body decrypted")
+	}
+}
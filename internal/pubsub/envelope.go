@@ -0,0 +1,185 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	SenderHeader        = "x-sender"
+	CausationIDHeader   = "x-causation-id"
+	SchemaVersionHeader = "x-schema-version"
+	// TraceParentHeader carries the W3C trace context of the span that
+	// published a message.
+	TraceParentHeader = "traceparent"
+)
+
+// DefaultSchemaVersion is sent for message types that do not implement
+// Versioned.
+const DefaultSchemaVersion = 1
+
+// Versioned lets a message type announce the version of its schema.
+type Versioned interface {
+	SchemaVersion() int
+}
+
+// Metadata is the envelope of a received message.
+type Metadata struct {
+	MessageID     string
+	CorrelationID string
+	CausationID   string
+	// TraceParent is the span handling the message once it is being
+	// processed, otherwise the span that published it.
+	TraceParent   string
+	ReplyTo       string
+	ContentType   string
+	Timestamp     time.Time
+	AppID         string
+	Sender        string
+	SchemaVersion int
+	Exchange      string
+	RoutingKey    string
+	Redelivered   bool
+	// Verified is set once Sender's signature was checked, see
+	// WithVerifier
+	Verified bool
+	Headers  amqp.Table
+}
+
+func MetadataFrom(d amqp.Delivery) Metadata {
+	meta := Metadata{
+		MessageID:     d.MessageId,
+		CorrelationID: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		ContentType:   d.ContentType,
+		Timestamp:     d.Timestamp,
+		AppID:         d.AppId,
+		Exchange:      d.Exchange,
+		RoutingKey:    d.RoutingKey,
+		Redelivered:   d.Redelivered,
+		Headers:       d.Headers,
+	}
+	meta.CausationID, _ = d.Headers[CausationIDHeader].(string)
+	meta.Sender, _ = d.Headers[SenderHeader].(string)
+	meta.TraceParent, _ = d.Headers[TraceParentHeader].(string)
+	version, _ := intArg(d.Headers, SchemaVersionHeader)
+	meta.SchemaVersion = int(version)
+	return meta
+}
+
+// Envelope stamps identity and causality onto messages published through
+// its Publisher. AppID and Sender only fill in missing values, while
+// CorrelationID and CausationID always win so a handler can tie what it
+// publishes to the message it is handling. TraceParent becomes the parent
+// of the publish spans of Publish.
+type Envelope struct {
+	AppID         string
+	Sender        string
+	CorrelationID string
+	CausationID   string
+	TraceParent   string
+}
+
+func (e Envelope) Publisher(ch Publisher) Publisher {
+	return &envelopePublisher{wrapper: wrapper{ch}, envelope: e}
+}
+
+// CausedBy returns a Publisher whose messages continue meta's correlation
+// and trace and name meta's message as their cause.
+func CausedBy(ch Publisher, meta Metadata) Publisher {
+	return Envelope{CorrelationID: meta.CorrelationID, CausationID: meta.MessageID, TraceParent: meta.TraceParent}.Publisher(ch)
+}
+
+type envelopePublisher struct {
+	wrapper
+	envelope Envelope
+}
+
+func (p *envelopePublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	msg.Headers = copyTable(msg.Headers)
+	if msg.AppId == "" {
+		msg.AppId = p.envelope.AppID
+	}
+	if _, ok := msg.Headers[SenderHeader]; !ok && p.envelope.Sender != "" {
+		msg.Headers[SenderHeader] = p.envelope.Sender
+	}
+	if p.envelope.CorrelationID != "" {
+		msg.CorrelationId = p.envelope.CorrelationID
+	}
+	if p.envelope.CausationID != "" {
+		msg.Headers[CausationIDHeader] = p.envelope.CausationID
+	}
+	return p.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+func (p *envelopePublisher) traceParent() string {
+	return p.envelope.TraceParent
+}
+
+// wrapper is embedded by publishers that pass messages on to ch, so
+// traceParentOf can look through them.
+type wrapper struct {
+	ch Publisher
+}
+
+func (w wrapper) unwrap() Publisher {
+	return w.ch
+}
+
+// traceParentOf finds the trace context set by the outermost Envelope
+// wrapping ch.
+func traceParentOf(ch Publisher) string {
+	for ch != nil {
+		if p, ok := ch.(interface{ traceParent() string }); ok && p.traceParent() != "" {
+			return p.traceParent()
+		}
+		w, ok := ch.(interface{ unwrap() Publisher })
+		if !ok {
+			return ""
+		}
+		ch = w.unwrap()
+	}
+	return ""
+}
+
+// stamp gives a new message its ID, timestamp and schema version. A
+// message that starts a conversation is its own correlation ID.
+func stamp(msg *amqp.Publishing, val any) {
+	msg.Headers = copyTable(msg.Headers)
+	if msg.MessageId == "" {
+		msg.MessageId = NewMessageID()
+	}
+	if msg.CorrelationId == "" {
+		msg.CorrelationId = msg.MessageId
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	version := DefaultSchemaVersion
+	if v, ok := val.(Versioned); ok {
+		version = v.SchemaVersion()
+	}
+	msg.Headers[SchemaVersionHeader] = int32(version)
+}
+
+// NewMessageID returns a random UUID (version 4).
+func NewMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	s := hex.EncodeToString(b[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+func copyTable(t amqp.Table) amqp.Table {
+	out := amqp.Table{}
+	for k, v := range t {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,80 @@
+package pubsub
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestTraceParentSeenThroughWrappers(t *testing.T) {
+	const parent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	inner := Envelope{TraceParent: parent}.Publisher(&recordingPublisher{})
+	outer := Compression{}.Publisher(Encryption{}.Publisher(MessageOptions{}.Publisher(inner)))
+	if got := traceParentOf(outer); got != parent {
+		t.Errorf("traceParentOf = %q, want %q", got, parent)
+	}
+	if got := traceParentOf(Compression{}.Publisher(&recordingPublisher{})); got != "" {
+		t.Errorf("traceParentOf without an envelope = %q", got)
+	}
+}
+
+type versionedMove struct{}
+
+func (versionedMove) SchemaVersion() int { return 3 }
+
+func TestEnvelopeStampsPublishedMessages(t *testing.T) {
+	target := &recordingPublisher{}
+	pub := Envelope{AppID: "peril-client", Sender: "alice"}.Publisher(target)
+	if err := PublishJSON(pub, "x", "k.a", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishJSON(pub, "x", "k.b", versionedMove{}); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := MetadataFrom(amqp.Delivery{
+		MessageId:     target.msgs[0].MessageId,
+		CorrelationId: target.msgs[0].CorrelationId,
+		AppId:         target.msgs[0].AppId,
+		Timestamp:     target.msgs[0].Timestamp,
+		Headers:       target.msgs[0].Headers,
+	})
+	if meta.MessageID == "" || meta.CorrelationID != meta.MessageID {
+		t.Errorf("message %q has correlation ID %q, want its own ID", meta.MessageID, meta.CorrelationID)
+	}
+	if meta.Timestamp.IsZero() {
+		t.Error("message has no timestamp")
+	}
+	if meta.AppID != "peril-client" || meta.Sender != "alice" {
+		t.Errorf("app %q, sender %q", meta.AppID, meta.Sender)
+	}
+	if meta.SchemaVersion != DefaultSchemaVersion {
+		t.Errorf("schema version = %d, want %d", meta.SchemaVersion, DefaultSchemaVersion)
+	}
+	if v, _ := intArg(target.msgs[1].Headers, SchemaVersionHeader); v != 3 {
+		t.Errorf("schema version of Versioned message = %d, want 3", v)
+	}
+	if target.msgs[0].MessageId == target.msgs[1].MessageId {
+		t.Error("two messages share a message ID")
+	}
+}
+
+func TestCausedByLinksToTheHandledMessage(t *testing.T) {
+	target := &recordingPublisher{}
+	cause := Metadata{MessageID: "m1", CorrelationID: "c1"}
+	// a sender set by an outer envelope is kept
+	pub := CausedBy(Envelope{Sender: "bob"}.Publisher(target), cause)
+	if err := PublishJSON(pub, "x", "k.a", "reply"); err != nil {
+		t.Fatal(err)
+	}
+	msg := target.msgs[0]
+	if msg.CorrelationId != "c1" || msg.Headers[CausationIDHeader] != "m1" {
+		t.Errorf("correlation %q, causation %v, want c1 and m1", msg.CorrelationId, msg.Headers[CausationIDHeader])
+	}
+	if msg.MessageId == "m1" {
+		t.Error("reply reused the ID of its cause")
+	}
+	if msg.Headers[SenderHeader] != "bob" {
+		t.Errorf("sender = %v, want bob", msg.Headers[SenderHeader])
+	}
+}
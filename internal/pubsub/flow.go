@@ -0,0 +1,118 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrBlocked is returned for publishes refused while the broker blocks
+// publishers.
+var ErrBlocked = errors.New("pubsub: broker is blocking publishers")
+
+// FlowControl tracks whether the broker blocks publishers. RabbitMQ does
+// so on memory and disk alarms, and a publish then hangs until the alarm
+// clears.
+type FlowControl struct {
+	mu        sync.Mutex
+	blocked   bool
+	reason    string
+	since     time.Time
+	unblocked chan struct{}
+}
+
+// WatchFlow follows conn's blocked notifications until it is closed.
+// Alarms are logged and exported as metrics.
+func WatchFlow(conn Broker) *FlowControl {
+	f := &FlowControl{unblocked: make(chan struct{})}
+	close(f.unblocked)
+	connectionBlocked.With().Set(0)
+	notifications := conn.NotifyBlocked(make(chan amqp.Blocking, 1))
+	go func() {
+		for b := range notifications {
+			f.set(b)
+		}
+	}()
+	return f
+}
+
+func (f *FlowControl) set(b amqp.Blocking) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if b.Active == f.blocked {
+		return
+	}
+	f.blocked = b.Active
+	if b.Active {
+		f.reason = b.Reason
+		f.since = time.Now()
+		f.unblocked = make(chan struct{})
+		connectionBlocked.With().Set(1)
+		connectionBlockedTotal.With().Inc()
+		Logger().Warn("broker is blocking publishers", "reason", b.Reason)
+		return
+	}
+	close(f.unblocked)
+	connectionBlocked.With().Set(0)
+	Logger().Info("broker stopped blocking publishers", "reason", f.reason, "blocked_for", time.Since(f.since))
+	f.reason = ""
+}
+
+// Blocked reports whether publishers are blocked, and why.
+func (f *FlowControl) Blocked() (bool, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.blocked, f.reason
+}
+
+// Wait returns once publishers are unblocked. While they are blocked it
+// fails at once if ctx has no deadline, otherwise it waits for ctx.
+func (f *FlowControl) Wait(ctx context.Context) error {
+	f.mu.Lock()
+	blocked, reason, unblocked := f.blocked, f.reason, f.unblocked
+	f.mu.Unlock()
+	if !blocked {
+		return nil
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		return fmt.Errorf("%w: %s", ErrBlocked, reason)
+	}
+	select {
+	case <-unblocked:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %s: %w", ErrBlocked, reason, ctx.Err())
+	}
+}
+
+// Publisher checks f before every publish on ch. While the broker blocks
+// publishers, a publish waits up to maxWait or its context's deadline,
+// whichever comes first, and then fails with ErrBlocked; with a zero
+// maxWait and no deadline it fails right away.
+func (f *FlowControl) Publisher(ch Publisher, maxWait time.Duration) Publisher {
+	return &flowPublisher{wrapper: wrapper{ch}, flow: f, maxWait: maxWait}
+}
+
+type flowPublisher struct {
+	wrapper
+	flow    *FlowControl
+	maxWait time.Duration
+}
+
+func (p *flowPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	wait := ctx
+	if p.maxWait > 0 {
+		var cancel context.CancelFunc
+		wait, cancel = context.WithTimeout(ctx, p.maxWait)
+		defer cancel()
+	}
+	if err := p.flow.Wait(wait); err != nil {
+		publishBlockedTotal.With(exchange, routingPrefix(key)).Inc()
+		return err
+	}
+	return p.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
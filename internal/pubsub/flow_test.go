@@ -0,0 +1,81 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// waitBlocked waits until f has seen the broker's notification.
+func waitBlocked(t *testing.T, f *FlowControl, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for blocked, _ := f.Blocked(); blocked != want; blocked, _ = f.Blocked() {
+		if time.Now().After(deadline) {
+			t.Fatalf("blocked is not %v", want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlowControlFailsFastWhileBlocked(t *testing.T) {
+	mem := newTopicBroker(t)
+	flow := WatchFlow(mem)
+	target := &recordingPublisher{}
+	pub := flow.Publisher(target, 0)
+	mem.SetBlocked(true, "low on memory")
+	waitBlocked(t, flow, true)
+
+	start := time.Now()
+	err := pub.PublishWithContext(context.Background(), "x", "k.a", false, false, amqp.Publishing{})
+	if !errors.Is(err, ErrBlocked) {
+		t.Fatalf("publish while blocked = %v, want ErrBlocked", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("publish without a deadline waited %v", time.Since(start))
+	}
+	if len(target.sent()) != 0 {
+		t.Error("message was sent while blocked")
+	}
+}
+
+func TestFlowControlWaitsUntilUnblockedOrDeadline(t *testing.T) {
+	mem := newTopicBroker(t)
+	flow := WatchFlow(mem)
+	target := &recordingPublisher{}
+	pub := flow.Publisher(target, time.Minute)
+	mem.SetBlocked(true, "low on disk")
+	waitBlocked(t, flow, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := pub.PublishWithContext(ctx, "x", "k.a", false, false, amqp.Publishing{})
+	if !errors.Is(err, ErrBlocked) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("publish past its deadline = %v", err)
+	}
+
+	published := make(chan error, 1)
+	go func() {
+		published <- pub.PublishWithContext(context.Background(), "x", "k.b", false, false, amqp.Publishing{})
+	}()
+	select {
+	case err := <-published:
+		t.Fatalf("publish returned %v while blocked", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	mem.SetBlocked(false, "")
+	select {
+	case err := <-published:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("publish still waiting after the alarm cleared")
+	}
+	if got := target.sent(); len(got) != 1 || got[0] != "k.b" {
+		t.Errorf("sent %v, want k.b", got)
+	}
+}
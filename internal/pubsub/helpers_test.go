@@ -0,0 +1,107 @@
+package pubsub
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var testBackoff = Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+
+// newTopicBroker returns a MemoryBroker with the topic exchange "x".
+func newTopicBroker(t *testing.T) *MemoryBroker {
+	t.Helper()
+	mem := NewMemoryBroker()
+	ch, _ := mem.Channel()
+	defer ch.Close()
+	if err := ch.ExchangeDeclare("x", "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	return mem
+}
+
+func publishRaw(t *testing.T, conn Broker, exchange, key string, msg amqp.Publishing) {
+	t.Helper()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if err := ch.PublishWithContext(context.Background(), exchange, key, false, false, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func closeSub(t *testing.T, sub *Subscription) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := sub.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+	select {
+	case d, ok := <-deliveries:
+		if !ok {
+			t.Fatal("deliveries closed")
+		}
+		return d
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delivery")
+	}
+	return amqp.Delivery{}
+}
+
+func declareQueue(t *testing.T, ch Channel, queue string) {
+	t.Helper()
+	if err := ch.ExchangeDeclare("x", "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind(queue, "k.*", "x", false, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordingPublisher records what it publishes. While fail returns an
+// error, publishes fail with it instead.
+type recordingPublisher struct {
+	mu   sync.Mutex
+	fail func(msg amqp.Publishing) error
+	msgs []amqp.Publishing
+	keys []string
+}
+
+func (p *recordingPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail != nil {
+		if err := p.fail(msg); err != nil {
+			return err
+		}
+	}
+	p.msgs = append(p.msgs, msg)
+	p.keys = append(p.keys, key)
+	return nil
+}
+
+func (p *recordingPublisher) setFail(fail func(msg amqp.Publishing) error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fail = fail
+}
+
+func (p *recordingPublisher) sent() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.keys)
+}
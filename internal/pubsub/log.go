@@ -0,0 +1,43 @@
+package pubsub
+
+import (
+	"log/slog"
+	"sync/atomic"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var logger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger pubsub reports to. Until it is called pubsub
+// uses slog.Default.
+func SetLogger(l *slog.Logger) {
+	logger.Store(l)
+}
+
+// Logger is the logger set with SetLogger.
+func Logger() *slog.Logger {
+	if l := logger.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
+
+// WithLogger reports the subscription's messages to l instead of Logger.
+func WithLogger(l *slog.Logger) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.logger = l
+	}
+}
+
+// messageLogger adds the fields identifying msg to l.
+func messageLogger(l *slog.Logger, msg amqp.Delivery) *slog.Logger {
+	l = l.With(
+		slog.String("message_id", msg.MessageId),
+		slog.String("routing_key", msg.RoutingKey),
+	)
+	if sender, ok := msg.Headers[SenderHeader].(string); ok {
+		l = l.With(slog.String("username", sender))
+	}
+	return l
+}
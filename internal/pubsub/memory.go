@@ -0,0 +1,989 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryBroker is an in-process Broker with the same routing, ack and
+// dead-letter behaviour as RabbitMQ for the features Peril uses. It lets
+// the client and server run without a real broker, e.g. inside go test.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	channels  map[*memChannel]struct{}
+	seq       uint64
+	msgSeq    uint64
+	notify    []chan *amqp.Error
+	blocked   []chan amqp.Blocking
+	notifier  *memNotifier
+	closed    bool
+}
+
+type memExchange struct {
+	name     string
+	kind     string
+	bindings []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+type memMessage struct {
+	id          uint64
+	exchange    string
+	routingKey  string
+	publishing  amqp.Publishing
+	redelivered bool
+	expires     time.Time
+	// returns counts requeues, for quorum queues' x-delivery-limit
+	returns int64
+}
+
+type memQueue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	args       amqp.Table
+	ready      []memMessage
+	consumers  []*memConsumer
+	next       int
+}
+
+type memConsumer struct {
+	tag       string
+	queue     *memQueue
+	ch        *memChannel
+	autoAck   bool
+	prefetch  int
+	unacked   int
+	pending   []amqp.Delivery
+	cond      *sync.Cond
+	cancelled bool
+	out       chan amqp.Delivery
+	done      chan struct{}
+}
+
+type memUnacked struct {
+	queue    *memQueue
+	consumer *memConsumer
+	msg      memMessage
+}
+
+type memChannel struct {
+	broker      *MemoryBroker
+	prefetch    int
+	nextTag     uint64
+	unacked     map[uint64]*memUnacked
+	consumers   map[string]*memConsumer
+	confirm     bool
+	publishSeq  uint64
+	confirms    []chan amqp.Confirmation
+	returns     []chan amqp.Return
+	cancels     []chan string
+	notifyClose []chan *amqp.Error
+	notifier    *memNotifier
+	closed      bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+		channels:  map[*memChannel]struct{}{},
+		notifier:  newMemNotifier(),
+	}
+}
+
+func (b *MemoryBroker) Channel() (Channel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &memChannel{
+		broker:    b,
+		unacked:   map[uint64]*memUnacked{},
+		consumers: map[string]*memConsumer{},
+		notifier:  newMemNotifier(),
+	}
+	b.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return amqp.ErrClosed
+	}
+	for ch := range b.channels {
+		ch.closeLocked()
+	}
+	for _, c := range b.notify {
+		close(c)
+	}
+	b.notify = nil
+	blocked := b.blocked
+	b.notifier.post(func() {
+		for _, c := range blocked {
+			close(c)
+		}
+	})
+	b.notifier.stop()
+	b.blocked = nil
+	b.closed = true
+	return nil
+}
+
+func (b *MemoryBroker) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(c)
+		return c
+	}
+	b.notify = append(b.notify, c)
+	return c
+}
+
+func (b *MemoryBroker) NotifyBlocked(c chan amqp.Blocking) chan amqp.Blocking {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(c)
+		return c
+	}
+	b.blocked = append(b.blocked, c)
+	return c
+}
+
+// SetBlocked simulates a resource alarm by notifying NotifyBlocked
+// listeners. Publishes are not actually held back.
+func (b *MemoryBroker) SetBlocked(active bool, reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	blocked := b.blocked
+	b.notifier.post(func() {
+		for _, c := range blocked {
+			c <- amqp.Blocking{Active: active, Reason: reason}
+		}
+	})
+}
+
+func (b *MemoryBroker) name(prefix string) string {
+	b.seq++
+	return fmt.Sprintf("%s-%d", prefix, b.seq)
+}
+
+// route delivers a message to every queue bound to exchange that matches
+// key. It reports whether at least one queue received the message.
+func (b *MemoryBroker) route(exchange, key string, msg amqp.Publishing) (bool, error) {
+	var targets []*memQueue
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			targets = append(targets, q)
+		}
+	} else {
+		ex, ok := b.exchanges[exchange]
+		if !ok {
+			return false, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange)}
+		}
+		seen := map[string]bool{}
+		for _, binding := range ex.bindings {
+			if seen[binding.queue] || !ex.matches(binding.key, key) {
+				continue
+			}
+			if q, ok := b.queues[binding.queue]; ok {
+				seen[binding.queue] = true
+				targets = append(targets, q)
+			}
+		}
+	}
+	for _, q := range targets {
+		b.enqueue(q, memMessage{exchange: exchange, routingKey: key, publishing: msg})
+	}
+	return len(targets) > 0, nil
+}
+
+func (b *MemoryBroker) enqueue(q *memQueue, msg memMessage) {
+	b.msgSeq++
+	msg.id = b.msgSeq
+	if ttl, ok := messageTTL(q.args, msg.publishing); ok {
+		msg.expires = time.Now().Add(ttl)
+		id := msg.id
+		time.AfterFunc(ttl, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.expire(q, id)
+		})
+	}
+	q.ready = append(q.ready, msg)
+	b.dispatch(q)
+}
+
+func (b *MemoryBroker) requeue(q *memQueue, msgs []memMessage) {
+	live := make([]memMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		if !msg.expires.IsZero() && time.Now().After(msg.expires) {
+			b.deadLetter(q, msg, "expired")
+			continue
+		}
+		msg.redelivered = true
+		msg.returns++
+		if limit, ok := intArg(q.args, "x-delivery-limit"); ok && msg.returns > limit {
+			b.deadLetter(q, msg, "delivery_limit")
+			continue
+		}
+		live = append(live, msg)
+	}
+	q.ready = append(live, q.ready...)
+	b.dispatch(q)
+}
+
+// expire dead-letters a message whose TTL ran out while it was waiting in
+// the queue. Messages held by a consumer are checked when requeued.
+func (b *MemoryBroker) expire(q *memQueue, id uint64) {
+	if b.closed || b.queues[q.name] != q {
+		return
+	}
+	for i, msg := range q.ready {
+		if msg.id == id {
+			q.ready = append(q.ready[:i], q.ready[i+1:]...)
+			b.deadLetter(q, msg, "expired")
+			return
+		}
+	}
+}
+
+// messageTTL is the lower of the queue's x-message-ttl and the message's
+// expiration, both in milliseconds.
+func messageTTL(args amqp.Table, msg amqp.Publishing) (time.Duration, bool) {
+	ttl, ok := intArg(args, "x-message-ttl")
+	if msg.Expiration != "" {
+		if exp, err := strconv.ParseInt(msg.Expiration, 10, 64); err == nil && (!ok || exp < ttl) {
+			ttl, ok = exp, true
+		}
+	}
+	return time.Duration(ttl) * time.Millisecond, ok
+}
+
+func intArg(args amqp.Table, key string) (int64, bool) {
+	switch v := args[key].(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+func (b *MemoryBroker) dispatch(q *memQueue) {
+	for len(q.ready) > 0 {
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+		msg := q.ready[0]
+		q.ready = q.ready[1:]
+		c.deliver(msg)
+	}
+}
+
+// deadLetter republishes msg to the queue's dead-letter exchange, if it has
+// one, recording why in the x-death header like RabbitMQ does.
+func (b *MemoryBroker) deadLetter(q *memQueue, msg memMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := msg.routingKey
+	if dlk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+	pub := msg.publishing
+	pub.Headers = withDeath(pub.Headers, q.name, reason, msg)
+	// RabbitMQ drops the expiration so the message does not expire again
+	pub.Expiration = ""
+	b.route(dlx, key, pub)
+}
+
+func withDeath(headers amqp.Table, queue, reason string, msg memMessage) amqp.Table {
+	h := copyTable(headers)
+	deaths, _ := h["x-death"].([]interface{})
+	updated := []interface{}{}
+	death := amqp.Table{
+		"count":        int64(1),
+		"reason":       reason,
+		"queue":        queue,
+		"time":         time.Now(),
+		"exchange":     msg.exchange,
+		"routing-keys": []interface{}{msg.routingKey},
+	}
+	for _, d := range deaths {
+		t, ok := d.(amqp.Table)
+		if ok && t["queue"] == queue && t["reason"] == reason {
+			count, _ := t["count"].(int64)
+			death["count"] = count + 1
+			continue
+		}
+		updated = append(updated, d)
+	}
+	h["x-death"] = append([]interface{}{death}, updated...)
+	if _, ok := h["x-first-death-reason"]; !ok {
+		h["x-first-death-reason"] = reason
+		h["x-first-death-queue"] = queue
+		h["x-first-death-exchange"] = msg.exchange
+	}
+	return h
+}
+
+func (b *MemoryBroker) deleteQueue(q *memQueue) {
+	delete(b.queues, q.name)
+	for _, c := range append([]*memConsumer(nil), q.consumers...) {
+		c.cancelLocked()
+		for _, n := range c.ch.cancels {
+			select {
+			case n <- c.tag:
+			default:
+			}
+		}
+	}
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, binding := range ex.bindings {
+			if binding.queue != q.name {
+				bindings = append(bindings, binding)
+			}
+		}
+		ex.bindings = bindings
+	}
+}
+
+func (ex *memExchange) matches(pattern, key string) bool {
+	switch ex.kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return TopicMatch(pattern, key)
+	default:
+		return pattern == key
+	}
+}
+
+// TopicMatch reports whether a routing key matches a topic binding pattern,
+// where "*" matches exactly one word and "#" matches zero or more words.
+func TopicMatch(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchWords(pattern[1:], key[1:])
+	}
+	return len(key) > 0 && pattern[0] == key[0] && matchWords(pattern[1:], key[1:])
+}
+
+func (q *memQueue) nextConsumer() *memConsumer {
+	for i := 0; i < len(q.consumers); i++ {
+		c := q.consumers[(q.next+i)%len(q.consumers)]
+		if c.autoAck || c.prefetch == 0 || c.unacked < c.prefetch {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return c
+		}
+	}
+	return nil
+}
+
+func (q *memQueue) removeConsumer(c *memConsumer) {
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	q.next = 0
+}
+
+func (c *memConsumer) deliver(msg memMessage) {
+	c.ch.nextTag++
+	tag := c.ch.nextTag
+	if !c.autoAck {
+		c.ch.unacked[tag] = &memUnacked{queue: c.queue, consumer: c, msg: msg}
+		c.unacked++
+	}
+	pub := msg.publishing
+	if _, ok := c.queue.args["x-delivery-limit"]; ok && msg.returns > 0 {
+		pub.Headers = copyTable(pub.Headers)
+		pub.Headers["x-delivery-count"] = msg.returns
+	}
+	c.pending = append(c.pending, amqp.Delivery{
+		Acknowledger:    c.ch,
+		Headers:         pub.Headers,
+		ContentType:     pub.ContentType,
+		ContentEncoding: pub.ContentEncoding,
+		DeliveryMode:    pub.DeliveryMode,
+		Priority:        pub.Priority,
+		CorrelationId:   pub.CorrelationId,
+		ReplyTo:         pub.ReplyTo,
+		Expiration:      pub.Expiration,
+		MessageId:       pub.MessageId,
+		Timestamp:       pub.Timestamp,
+		Type:            pub.Type,
+		UserId:          pub.UserId,
+		AppId:           pub.AppId,
+		ConsumerTag:     c.tag,
+		DeliveryTag:     tag,
+		Redelivered:     msg.redelivered,
+		Exchange:        msg.exchange,
+		RoutingKey:      msg.routingKey,
+		Body:            pub.Body,
+	})
+	c.cond.Signal()
+}
+
+// run forwards pending deliveries to the consumer's channel. It runs
+// without the broker lock held while sending so slow handlers never block
+// routing.
+func (c *memConsumer) run() {
+	defer close(c.out)
+	mu := &c.ch.broker.mu
+	mu.Lock()
+	for {
+		for len(c.pending) == 0 && !c.cancelled {
+			c.cond.Wait()
+		}
+		if c.cancelled {
+			mu.Unlock()
+			return
+		}
+		d := c.pending[0]
+		c.pending = c.pending[1:]
+		mu.Unlock()
+		select {
+		case c.out <- d:
+		case <-c.done:
+			return
+		}
+		mu.Lock()
+	}
+}
+
+// cancelLocked stops the consumer and returns deliveries it never handed
+// to the application to the queue.
+func (c *memConsumer) cancelLocked() {
+	if c.cancelled {
+		return
+	}
+	c.cancelled = true
+	close(c.done)
+	c.cond.Signal()
+	delete(c.ch.consumers, c.tag)
+	c.queue.removeConsumer(c)
+
+	var msgs []memMessage
+	for _, d := range c.pending {
+		if u, ok := c.ch.unacked[d.DeliveryTag]; ok {
+			delete(c.ch.unacked, d.DeliveryTag)
+			c.unacked--
+			msgs = append(msgs, u.msg)
+		}
+	}
+	c.pending = nil
+
+	b := c.ch.broker
+	if c.queue.autoDelete && len(c.queue.consumers) == 0 {
+		b.deleteQueue(c.queue)
+		return
+	}
+	b.requeue(c.queue, msgs)
+}
+
+// PublishWithContext routes msg and, like RabbitMQ, sends unroutable
+// mandatory messages to NotifyReturn listeners before confirming them to
+// NotifyPublish listeners. Notifications are sent in order without holding
+// up the broker; a listener not drained only delays its own channel's.
+func (ch *memChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	routed, err := b.route(exchange, key, msg)
+	if err != nil {
+		return err
+	}
+	if mandatory && !routed {
+		returns := ch.returns
+		ret := amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         msg.Headers,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Body:            msg.Body,
+		}
+		ch.notifier.post(func() {
+			for _, c := range returns {
+				c <- ret
+			}
+		})
+	}
+	if ch.confirm {
+		ch.publishSeq++
+		confirms, confirmation := ch.confirms, amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: true}
+		ch.notifier.post(func() {
+			for _, c := range confirms {
+				c <- confirmation
+			}
+		})
+	}
+	return nil
+}
+
+func (ch *memChannel) Confirm(noWait bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirm = true
+	return nil
+}
+
+func (ch *memChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(confirm)
+		return confirm
+	}
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+func (ch *memChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.returns = append(ch.returns, c)
+	return c
+}
+
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind {
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg 'type' for exchange '%s'", name)}
+		}
+		return nil
+	}
+	b.exchanges[name] = &memExchange{name: name, kind: kind}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		name = b.name("amq.gen")
+	}
+	q, ok := b.queues[name]
+	if ok && (q.durable != durable || !equivalentArgs(q.args, args)) {
+		return amqp.Queue{}, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for queue '%s'", name)}
+	}
+	if !ok {
+		q = &memQueue{
+			name:       name,
+			durable:    durable,
+			autoDelete: autoDelete,
+			exclusive:  exclusive,
+			args:       args,
+		}
+		b.queues[name] = q
+	}
+	return amqp.Queue{Name: q.name, Messages: len(q.ready), Consumers: len(q.consumers)}, nil
+}
+
+// QueueDelete deletes a queue and returns how many messages it held. Its
+// consumers are cancelled by the broker, as on RabbitMQ.
+func (ch *memChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, nil
+	}
+	if (ifUnused && len(q.consumers) > 0) || (ifEmpty && len(q.ready) > 0) {
+		return 0, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in use", name)}
+	}
+	n := len(q.ready)
+	b.deleteQueue(q)
+	return n, nil
+}
+
+func equivalentArgs(a, b amqp.Table) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (ch *memChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.exchanges[name]; !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", name)}
+	}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name)}
+	}
+	return amqp.Queue{Name: q.name, Messages: len(q.ready), Consumers: len(q.consumers)}, nil
+}
+
+func (ch *memChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.queues[name]; !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name)}
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange)}
+	}
+	for _, binding := range ex.bindings {
+		if binding.queue == name && binding.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: name, key: key})
+	return nil
+}
+
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *memChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", queue)}
+	}
+	if consumer == "" {
+		consumer = b.name("ctag")
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, &amqp.Error{Code: amqp.NotAllowed, Reason: fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumer)}
+	}
+	c := &memConsumer{
+		tag:      consumer,
+		queue:    q,
+		ch:       ch,
+		autoAck:  autoAck,
+		prefetch: ch.prefetch,
+		cond:     sync.NewCond(&b.mu),
+		out:      make(chan amqp.Delivery),
+		done:     make(chan struct{}),
+	}
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+	go c.run()
+	b.dispatch(q)
+	return c.out, nil
+}
+
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if c, ok := ch.consumers[consumer]; ok {
+		c.cancelLocked()
+	}
+	return nil
+}
+
+// NotifyCancel reports consumers cancelled by the broker, which happens
+// when their queue is deleted.
+func (ch *memChannel) NotifyCancel(c chan string) chan string {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.cancels = append(ch.cancels, c)
+	return c
+}
+
+func (ch *memChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.notifyClose = append(ch.notifyClose, c)
+	return c
+}
+
+func (ch *memChannel) Close() error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.closeLocked()
+	return nil
+}
+
+// closeLocked cancels the channel's consumers and requeues everything it
+// had not acknowledged, the same as a channel closing on RabbitMQ.
+func (ch *memChannel) closeLocked() {
+	for _, c := range ch.consumers {
+		c.cancelLocked()
+	}
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, tag := range tags {
+		u := ch.unacked[tag]
+		delete(ch.unacked, tag)
+		u.consumer.unacked--
+		if _, ok := ch.broker.queues[u.queue.name]; ok {
+			ch.broker.requeue(u.queue, []memMessage{u.msg})
+		}
+	}
+	for _, c := range ch.cancels {
+		close(c)
+	}
+	// after the notifications still on their way
+	confirms, returns, notifyClose := ch.confirms, ch.returns, ch.notifyClose
+	ch.notifier.post(func() {
+		for _, c := range confirms {
+			close(c)
+		}
+		for _, c := range returns {
+			close(c)
+		}
+		for _, c := range notifyClose {
+			close(c)
+		}
+	})
+	ch.notifier.stop()
+	ch.confirms, ch.returns, ch.cancels, ch.notifyClose = nil, nil, nil, nil
+	ch.closed = true
+	delete(ch.broker.channels, ch)
+}
+
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, func(u *memUnacked) {
+		ch.broker.dispatch(u.queue)
+	})
+}
+
+func (ch *memChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	return ch.settle(tag, multiple, func(u *memUnacked) {
+		if requeue {
+			ch.broker.requeue(u.queue, []memMessage{u.msg})
+			return
+		}
+		ch.broker.deadLetter(u.queue, u.msg, "rejected")
+		ch.broker.dispatch(u.queue)
+	})
+}
+
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+func (ch *memChannel) settle(tag uint64, multiple bool, fn func(*memUnacked)) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	tags := []uint64{tag}
+	if multiple {
+		tags = tags[:0]
+		for t := range ch.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	}
+	for _, t := range tags {
+		u, ok := ch.unacked[t]
+		if !ok {
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", t)}
+		}
+		delete(ch.unacked, t)
+		u.consumer.unacked--
+		fn(u)
+	}
+	return nil
+}
+
+// memNotifier sends notifications to listeners in order on a goroutine of
+// its own, so a listener that does not drain its channel only holds up
+// later notifications of the same channel, not the whole broker.
+type memNotifier struct {
+	mu       sync.Mutex
+	pending  []func()
+	stopping bool
+	wake     chan struct{}
+}
+
+func newMemNotifier() *memNotifier {
+	n := &memNotifier{wake: make(chan struct{}, 1)}
+	go n.run()
+	return n
+}
+
+func (n *memNotifier) post(fn func()) {
+	n.mu.Lock()
+	if !n.stopping {
+		n.pending = append(n.pending, fn)
+	}
+	n.mu.Unlock()
+	n.signal()
+}
+
+// stop ends the goroutine once the notifications posted so far are sent.
+func (n *memNotifier) stop() {
+	n.mu.Lock()
+	n.stopping = true
+	n.mu.Unlock()
+	n.signal()
+}
+
+func (n *memNotifier) signal() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *memNotifier) run() {
+	for range n.wake {
+		for {
+			n.mu.Lock()
+			if len(n.pending) == 0 {
+				stopping := n.stopping
+				n.mu.Unlock()
+				if stopping {
+					return
+				}
+				break
+			}
+			fn := n.pending[0]
+			n.pending = n.pending[1:]
+			n.mu.Unlock()
+			fn()
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package pubsub
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// drain collects the routing keys of every message in queue, acking them.
+func drain(t *testing.T, ch Channel, queue string) []string {
+	t.Helper()
+	deliveries, err := ch.Consume(queue, "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for {
+		select {
+		case d := <-deliveries:
+			keys = append(keys, d.RoutingKey)
+		case <-time.After(50 * time.Millisecond):
+			slices.Sort(keys)
+			return keys
+		}
+	}
+}
+
+func TestMemoryTopicWildcards(t *testing.T) {
+	mem := newTopicBroker(t)
+	ch, _ := mem.Channel()
+	defer ch.Close()
+	bindings := map[string]string{
+		"one":   "game.*",
+		"any":   "game.#",
+		"all":   "#",
+		"tail":  "*.war",
+		"exact": "game.war",
+	}
+	for queue, pattern := range bindings {
+		if _, err := ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := ch.QueueBind(queue, pattern, "x", false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"game", "game.war", "game.war.won", "army.war"} {
+		publishRaw(t, mem, "x", key, amqp.Publishing{Body: []byte(key)})
+	}
+
+	want := map[string][]string{
+		"one":   {"game.war"},
+		"any":   {"game", "game.war", "game.war.won"},
+		"all":   {"army.war", "game", "game.war", "game.war.won"},
+		"tail":  {"army.war", "game.war"},
+		"exact": {"game.war"},
+	}
+	for queue, keys := range want {
+		if got := drain(t, ch, queue); !slices.Equal(got, keys) {
+			t.Errorf("%s (%s) got %v, want %v", queue, bindings[queue], got, keys)
+		}
+	}
+}
+
+func TestMemoryAckNackRequeue(t *testing.T) {
+	mem := newTopicBroker(t)
+	ch, _ := mem.Channel()
+	defer ch.Close()
+	declareQueue(t, ch, "q")
+	deliveries, err := ch.Consume("q", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishRaw(t, mem, "x", "k.a", amqp.Publishing{Body: []byte("m")})
+
+	first := receive(t, deliveries)
+	if first.Redelivered {
+		t.Error("first delivery is marked redelivered")
+	}
+	if err := first.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	again := receive(t, deliveries)
+	if !again.Redelivered || string(again.Body) != "m" {
+		t.Fatalf("requeued delivery = %q, redelivered %v", again.Body, again.Redelivered)
+	}
+	if err := again.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-deliveries:
+		t.Fatalf("acked message delivered again: %q", d.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// deadLetterQueue declares queue q dead-lettering to the fanout exchange
+// "dlx", and the queue "dead" bound to it.
+func deadLetterQueue(t *testing.T, ch Channel, args amqp.Table) {
+	t.Helper()
+	if err := ch.ExchangeDeclare("dlx", "fanout", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("dead", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("dead", "", "dlx", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	args["x-dead-letter-exchange"] = "dlx"
+	if _, err := ch.QueueDeclare("q", true, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("q", "k.*", "x", false, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryDeadLettersRejected(t *testing.T) {
+	mem := newTopicBroker(t)
+	ch, _ := mem.Channel()
+	defer ch.Close()
+	deadLetterQueue(t, ch, amqp.Table{})
+	deliveries, err := ch.Consume("q", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishRaw(t, mem, "x", "k.a", amqp.Publishing{Body: []byte("m")})
+	if err := receive(t, deliveries).Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	dead, err := ch.Consume("dead", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := NewDeadLetter(receive(t, dead))
+	if dl.Reason != "rejected" || dl.Queue != "q" || dl.Exchange != "x" || dl.RoutingKey != "k.a" || dl.Count != 1 {
+		t.Fatalf("dead letter = %+v", dl)
+	}
+}
+
+func TestMemoryDeadLettersExpired(t *testing.T) {
+	mem := newTopicBroker(t)
+	ch, _ := mem.Channel()
+	defer ch.Close()
+	deadLetterQueue(t, ch, amqp.Table{"x-message-ttl": int64(10)})
+	publishRaw(t, mem, "x", "k.a", amqp.Publishing{Body: []byte("m")})
+
+	dead, err := ch.Consume("dead", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl := NewDeadLetter(receive(t, dead)); dl.Reason != "expired" || dl.Queue != "q" {
+		t.Fatalf("dead letter = %+v", dl)
+	}
+}
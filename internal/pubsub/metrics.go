@@ -0,0 +1,72 @@
+package pubsub
+
+import (
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/metrics"
+)
+
+// Metrics are recorded to metrics.Default. Routing keys are reduced to
+// their first segment (army_moves, war, game_logs...) so per-player keys
+// do not each get their own series.
+var (
+	publishedTotal = metrics.Default.NewCounterVec("pubsub_published_total",
+		"Messages published.", "exchange", "routing_prefix")
+	ackedTotal = metrics.Default.NewCounterVec("pubsub_acked_total",
+		"Messages handled and acked.", "exchange", "queue", "routing_prefix")
+	nackedRequeueTotal = metrics.Default.NewCounterVec("pubsub_nacked_requeue_total",
+		"Messages nacked back onto their queue.", "exchange", "queue", "routing_prefix")
+	nackedDiscardTotal = metrics.Default.NewCounterVec("pubsub_nacked_discard_total",
+		"Messages nacked without requeueing.", "exchange", "queue", "routing_prefix")
+	nackedRetryTotal = metrics.Default.NewCounterVec("pubsub_nacked_retry_total",
+		"Messages sent for a delayed retry.", "exchange", "queue", "routing_prefix")
+	decodeFailuresTotal = metrics.Default.NewCounterVec("pubsub_decode_failures_total",
+		"Messages that could not be decoded.", "exchange", "queue", "routing_prefix")
+	duplicatesTotal = metrics.Default.NewCounterVec("pubsub_duplicates_total",
+		"Messages skipped as already processed.", "exchange", "queue", "routing_prefix")
+	signatureFailuresTotal = metrics.Default.NewCounterVec("pubsub_signature_failures_total",
+		"Messages discarded for a missing or wrong signature.", "exchange", "queue", "routing_prefix")
+	handlerSeconds = metrics.Default.NewHistogramVec("pubsub_handler_duration_seconds",
+		"Time spent in message handlers.", nil, "exchange", "queue", "routing_prefix")
+	inFlight = metrics.Default.NewGaugeVec("pubsub_in_flight",
+		"Messages currently being processed.", "exchange", "queue", "routing_prefix")
+	connectionBlocked = metrics.Default.NewGaugeVec("pubsub_connection_blocked",
+		"1 while the broker blocks publishers on a resource alarm.")
+	connectionBlockedTotal = metrics.Default.NewCounterVec("pubsub_connection_blocked_total",
+		"Resource alarms that blocked publishers.")
+	publishBlockedTotal = metrics.Default.NewCounterVec("pubsub_publish_blocked_total",
+		"Publishes refused because the broker blocked publishers.", "exchange", "routing_prefix")
+	publishRateLimitedTotal = metrics.Default.NewCounterVec("pubsub_publish_rate_limited_total",
+		"Publishes refused for going over their rate limit.", "exchange", "routing_prefix")
+	quotaExceededTotal = metrics.Default.NewCounterVec("pubsub_quota_exceeded_total",
+		"Received messages beyond their sender's quota.", "routing_prefix")
+	outboxPending = metrics.Default.NewGaugeVec("pubsub_outbox_pending",
+		"Messages in the outbox waiting to be sent.")
+)
+
+func routingPrefix(key string) string {
+	prefix, _, _ := strings.Cut(key, ".")
+	return prefix
+}
+
+func recordPublished(exchange, key string) {
+	publishedTotal.With(exchange, routingPrefix(key)).Inc()
+}
+
+func recordAck(ack Acktype, labels ...string) {
+	switch ack {
+	case Ack:
+		ackedTotal.With(labels...).Inc()
+	case NackRequeue:
+		nackedRequeueTotal.With(labels...).Inc()
+	case NackDiscard:
+		nackedDiscardTotal.With(labels...).Inc()
+	case NackRetry:
+		nackedRetryTotal.With(labels...).Inc()
+	}
+}
+
+func observeHandler(start time.Time, labels ...string) {
+	handlerSeconds.With(labels...).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,89 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/metrics"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// sample reads the current value of one series from metrics.Default, 0 if
+// it was not recorded yet.
+func sample(t *testing.T, series string) float64 {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := metrics.Default.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		if val, ok := strings.CutPrefix(scanner.Text(), series+" "); ok {
+			f, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f
+		}
+	}
+	return 0
+}
+
+func TestMetricsCountPublishesAndAcks(t *testing.T) {
+	const (
+		published = `pubsub_published_total{exchange="x",routing_prefix="metered"}`
+		acked     = `pubsub_acked_total{exchange="x",queue="metered",routing_prefix="metered"}`
+		discarded = `pubsub_nacked_discard_total{exchange="x",queue="metered",routing_prefix="metered"}`
+		failed    = `pubsub_decode_failures_total{exchange="x",queue="metered",routing_prefix="metered"}`
+	)
+	before := map[string]float64{}
+	for _, series := range []string{published, acked, discarded, failed} {
+		before[series] = sample(t, series)
+	}
+
+	mem := newTopicBroker(t)
+	handled := make(chan struct{}, 3)
+	sub, err := Subscribe(mem, "x", "metered", "metered.*", Durable, func(ok bool) Acktype {
+		handled <- struct{}{}
+		if ok {
+			return Ack
+		}
+		return NackDiscard
+	}, DecodeJSON[bool], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSub(t, sub)
+	ch, _ := mem.Channel()
+	defer ch.Close()
+	// the undecodable message goes first, so it is counted once the
+	// others were handled
+	publishRaw(t, mem, "x", "metered.a", amqp.Publishing{Body: []byte("not json")})
+	for _, ok := range []bool{true, true, false} {
+		if err := PublishJSON(ch, "x", "metered.a", ok); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-handled:
+		case <-time.After(2 * time.Second):
+			t.Fatal("message was not handled")
+		}
+	}
+	// the last ack is counted just after the handler returns
+	for deadline := time.Now().Add(time.Second); sample(t, discarded) == before[discarded] && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	want := map[string]float64{published: 3, acked: 2, discarded: 1, failed: 1}
+	for series, delta := range want {
+		if got := sample(t, series) - before[series]; got != delta {
+			t.Errorf("%s went up by %v, want %v", series, got, delta)
+		}
+	}
+}
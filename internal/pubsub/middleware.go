@@ -0,0 +1,119 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// Handler handles one decoded message. ctx carries deadlines set by
+// middleware such as Timeout.
+type Handler[T any] func(ctx context.Context, val T, meta Metadata) Acktype
+
+// Middleware wraps a Handler, e.g. to observe or guard every message of a
+// subscription.
+type Middleware[T any] func(Handler[T]) Handler[T]
+
+// Chain composes middlewares into one. The first is the outermost, so it
+// sees each message first and its outcome last.
+func Chain[T any](mws ...Middleware[T]) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		for i := len(mws) - 1; i >= 0; i-- {
+			next = mws[i](next)
+		}
+		return next
+	}
+}
+
+// WithMiddleware wraps the subscription's handler in mws. Their type has
+// to match the subscription's message type, Subscribe fails otherwise.
+func WithMiddleware[T any](mws ...Middleware[T]) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		for _, mw := range mws {
+			cfg.middleware = append(cfg.middleware, mw)
+		}
+	}
+}
+
+// middlewareFor recovers the typed middlewares of a subscription of T.
+func middlewareFor[T any](mws []any) ([]Middleware[T], error) {
+	typed := make([]Middleware[T], 0, len(mws))
+	for _, mw := range mws {
+		m, ok := mw.(Middleware[T])
+		if !ok {
+			var val T
+			return nil, fmt.Errorf("middleware %T does not handle %T messages", mw, val)
+		}
+		typed = append(typed, m)
+	}
+	return typed, nil
+}
+
+// Recover turns a panicking handler into a NackDiscard instead of losing
+// the worker, and with it the unacked message, to the panic. It is
+// opt-in, pass it to WithMiddleware.
+func Recover[T any]() Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(ctx context.Context, val T, meta Metadata) (ack Acktype) {
+			defer func() {
+				if r := recover(); r != nil {
+					Logger().Error("handler panicked", "message_id", meta.MessageID, "routing_key", meta.RoutingKey, "panic", r, "stack", string(debug.Stack()))
+					ack = NackDiscard
+				}
+			}()
+			return next(ctx, val, meta)
+		}
+	}
+}
+
+// Logging logs every handled message with its outcome. A nil logger uses
+// Logger.
+func Logging[T any](l *slog.Logger) Middleware[T] {
+	if l == nil {
+		l = Logger()
+	}
+	return func(next Handler[T]) Handler[T] {
+		return func(ctx context.Context, val T, meta Metadata) Acktype {
+			start := time.Now()
+			ack := next(ctx, val, meta)
+			level := slog.LevelInfo
+			if ack != Ack {
+				level = slog.LevelWarn
+			}
+			l.LogAttrs(ctx, level, "message handled",
+				slog.String("message_id", meta.MessageID),
+				slog.String("exchange", meta.Exchange),
+				slog.String("routing_key", meta.RoutingKey),
+				slog.String("ack", ack.String()),
+				slog.Duration("took", time.Since(start)),
+			)
+			return ack
+		}
+	}
+}
+
+// Timing reports how long the handler took for each message.
+func Timing[T any](observe func(meta Metadata, ack Acktype, took time.Duration)) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(ctx context.Context, val T, meta Metadata) Acktype {
+			start := time.Now()
+			ack := next(ctx, val, meta)
+			observe(meta, ack, time.Since(start))
+			return ack
+		}
+	}
+}
+
+// Timeout gives the handler a context that expires after d. Handlers have
+// to watch ctx for it to have an effect.
+func Timeout[T any](d time.Duration) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(ctx context.Context, val T, meta Metadata) Acktype {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			return next(ctx, val, meta)
+		}
+	}
+}
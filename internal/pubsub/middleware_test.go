@@ -0,0 +1,93 @@
+package pubsub
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestChainRunsFirstMiddlewareOutermost(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware[string] {
+		return func(next Handler[string]) Handler[string] {
+			return func(ctx context.Context, val string, meta Metadata) Acktype {
+				calls = append(calls, name+" in")
+				ack := next(ctx, val, meta)
+				calls = append(calls, name+" out")
+				return ack
+			}
+		}
+	}
+	handler := Chain(trace("a"), trace("b"))(func(context.Context, string, Metadata) Acktype {
+		calls = append(calls, "handler")
+		return Ack
+	})
+	handler(context.Background(), "", Metadata{})
+	want := []string{"a in", "b in", "handler", "b out", "a out"}
+	if !slices.Equal(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestRecoverDiscardsPanickingMessages(t *testing.T) {
+	handler := Recover[string]()(func(context.Context, string, Metadata) Acktype {
+		panic("bad move")
+	})
+	if got := handler(context.Background(), "", Metadata{}); got != NackDiscard {
+		t.Fatalf("panicking handler = %v, want NackDiscard", got)
+	}
+}
+
+func TestRecoverKeepsSubscriptionRunning(t *testing.T) {
+	mem := newTopicBroker(t)
+	handled := make(chan string, 1)
+	sub, err := Subscribe(mem, "x", "q", "k.*", Durable, func(s string) Acktype {
+		if s == "panic" {
+			panic("bad move")
+		}
+		handled <- s
+		return Ack
+	}, DecodeJSON[string], nil, WithMiddleware(Recover[string]()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSub(t, sub)
+	publishRaw(t, mem, "x", "k.a", amqp.Publishing{Body: []byte(`"panic"`)})
+	publishRaw(t, mem, "x", "k.a", amqp.Publishing{Body: []byte(`"ok"`)})
+	select {
+	case s := <-handled:
+		if s != "ok" {
+			t.Fatalf("handled %q", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription stopped after a panic")
+	}
+	if n := queueLength(t, mem, "q"); n != 0 {
+		t.Errorf("%d messages left, the panicking one was not discarded", n)
+	}
+}
+
+func TestWithMiddlewareRejectsOtherMessageType(t *testing.T) {
+	mem := newTopicBroker(t)
+	_, err := Subscribe(mem, "x", "q", "k.*", Durable, func(string) Acktype {
+		return Ack
+	}, DecodeJSON[string], nil, WithMiddleware(Recover[int]()))
+	if err == nil {
+		t.Fatal("subscribed with middleware for int messages")
+	}
+}
+
+func TestTimeoutSetsDeadline(t *testing.T) {
+	handler := Timeout[string](time.Minute)(func(ctx context.Context, _ string, _ Metadata) Acktype {
+		if _, ok := ctx.Deadline(); !ok {
+			return NackDiscard
+		}
+		return Ack
+	})
+	if got := handler(context.Background(), "", Metadata{}); got != Ack {
+		t.Error("handler context has no deadline")
+	}
+}
@@ -0,0 +1,580 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// MessagePack encoding of Go values. Structs are written as maps keyed by
+// field name, like encoding/json does without tags, and time.Time uses the
+// standard timestamp extension.
+
+var timeType = reflect.TypeOf(time.Time{})
+
+const msgpackTimeExt int8 = -1
+
+func marshalMsgpack(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeMsgpack(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeMsgpack(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteByte(0xc0)
+		return nil
+	}
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		buf.Write([]byte{0xc7, 12, 0xff}) // ext 8, type -1
+		binary.Write(buf, binary.BigEndian, uint32(t.Nanosecond()))
+		binary.Write(buf, binary.BigEndian, t.Unix())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeMsgpackInt(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeMsgpackUint(buf, v.Uint())
+	case reflect.Float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v.Float()))
+	case reflect.String:
+		writeMsgpackString(buf, v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			writeMsgpackBin(buf, v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		writeMsgpackHeader(buf, v.Len(), 0x90, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeMsgpack(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		writeMsgpackHeader(buf, v.Len(), 0x80, 0xde, 0xdf)
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := encodeMsgpack(buf, iter.Key()); err != nil {
+				return err
+			}
+			if err := encodeMsgpack(buf, iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		fields := []int{}
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				fields = append(fields, i)
+			}
+		}
+		writeMsgpackHeader(buf, len(fields), 0x80, 0xde, 0xdf)
+		for _, i := range fields {
+			writeMsgpackString(buf, t.Field(i).Name)
+			if err := encodeMsgpack(buf, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		return encodeMsgpack(buf, v.Elem())
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		writeMsgpackUint(buf, uint64(i))
+	case i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8:
+		buf.Write([]byte{0xd0, byte(int8(i))})
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func writeMsgpackUint(buf *bytes.Buffer, u uint64) {
+	switch {
+	case u < 128:
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		buf.Write([]byte{0xcc, byte(u)})
+	case u <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(u))
+	case u <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(u))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, u)
+	}
+}
+
+func writeMsgpackString(buf *bytes.Buffer, s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteString(s)
+}
+
+func writeMsgpackBin(buf *bytes.Buffer, b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		buf.Write([]byte{0xc4, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xc5)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xc6)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.Write(b)
+}
+
+// writeMsgpackHeader writes an array or map length using its fix, 16 and
+// 32 bit forms.
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fix, b16, b32 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+type msgpackPair struct {
+	key   any
+	value any
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func unmarshalMsgpack(data []byte, v any) error {
+	dst := reflect.ValueOf(v)
+	if dst.Kind() != reflect.Pointer || dst.IsNil() {
+		return fmt.Errorf("msgpack: decode target must be a non-nil pointer, got %T", v)
+	}
+	d := &msgpackDecoder{data: data}
+	src, err := d.value()
+	if err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(data)-d.pos)
+	}
+	return assignMsgpack(dst.Elem(), src)
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// value parses the next value into nil, bool, int64, uint64, float64,
+// string, []byte, time.Time, []any or []msgpackPair.
+func (d *msgpackDecoder) value() (any, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.mapOf(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.arrayOf(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.read(int(n))
+		return append([]byte(nil), b...), err
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.uint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(int(n))
+	case 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (c - 0xcc))
+	case 0xd0:
+		u, err := d.uint(1)
+		return int64(int8(u)), err
+	case 0xd1:
+		u, err := d.uint(2)
+		return int64(int16(u)), err
+	case 0xd2:
+		u, err := d.uint(4)
+		return int64(int32(u)), err
+	case 0xd3:
+		u, err := d.uint(8)
+		return int64(u), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayOf(int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: invalid type byte 0x%x", c)
+}
+
+func (d *msgpackDecoder) str(n int) (any, error) {
+	b, err := d.read(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) arrayOf(n int) (any, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	items := make([]any, n)
+	for i := range items {
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		items[i] = v
+	}
+	return items, nil
+}
+
+func (d *msgpackDecoder) mapOf(n int) (any, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	pairs := make([]msgpackPair, n)
+	for i := range pairs {
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		pairs[i] = msgpackPair{key: k, value: v}
+	}
+	return pairs, nil
+}
+
+func (d *msgpackDecoder) ext(n int) (any, error) {
+	b, err := d.read(n + 1)
+	if err != nil {
+		return nil, err
+	}
+	if int8(b[0]) != msgpackTimeExt {
+		return nil, fmt.Errorf("msgpack: unsupported extension type %d", int8(b[0]))
+	}
+	data := b[1:]
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	case 8:
+		u := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(u&0x3ffffffff), int64(u>>34)), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(data[:4])
+		sec := int64(binary.BigEndian.Uint64(data[4:]))
+		return time.Unix(sec, int64(nsec)), nil
+	}
+	return nil, fmt.Errorf("msgpack: invalid timestamp length %d", n)
+}
+
+func assignMsgpack(dst reflect.Value, src any) error {
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	if dst.Kind() == reflect.Pointer {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return assignMsgpack(dst.Elem(), src)
+	}
+	if dst.Kind() == reflect.Interface && dst.NumMethod() == 0 {
+		dst.Set(reflect.ValueOf(genericMsgpack(src)))
+		return nil
+	}
+	mismatch := fmt.Errorf("msgpack: cannot decode %T into %s", src, dst.Type())
+
+	if dst.Type() == timeType {
+		t, ok := src.(time.Time)
+		if !ok {
+			return mismatch
+		}
+		dst.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return mismatch
+		}
+		dst.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch n := src.(type) {
+		case int64:
+			i = n
+		case uint64:
+			if n > math.MaxInt64 {
+				return mismatch
+			}
+			i = int64(n)
+		default:
+			return mismatch
+		}
+		if dst.OverflowInt(i) {
+			return fmt.Errorf("msgpack: %d overflows %s", i, dst.Type())
+		}
+		dst.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch n := src.(type) {
+		case uint64:
+			u = n
+		case int64:
+			if n < 0 {
+				return mismatch
+			}
+			u = uint64(n)
+		default:
+			return mismatch
+		}
+		if dst.OverflowUint(u) {
+			return fmt.Errorf("msgpack: %d overflows %s", u, dst.Type())
+		}
+		dst.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch n := src.(type) {
+		case float64:
+			dst.SetFloat(n)
+		case int64:
+			dst.SetFloat(float64(n))
+		case uint64:
+			dst.SetFloat(float64(n))
+		default:
+			return mismatch
+		}
+	case reflect.String:
+		switch s := src.(type) {
+		case string:
+			dst.SetString(s)
+		case []byte:
+			dst.SetString(string(s))
+		default:
+			return mismatch
+		}
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			switch b := src.(type) {
+			case []byte:
+				dst.SetBytes(b)
+				return nil
+			case string:
+				dst.SetBytes([]byte(b))
+				return nil
+			}
+		}
+		items, ok := src.([]any)
+		if !ok {
+			return mismatch
+		}
+		slice := reflect.MakeSlice(dst.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := assignMsgpack(slice.Index(i), item); err != nil {
+				return err
+			}
+		}
+		dst.Set(slice)
+	case reflect.Array:
+		items, ok := src.([]any)
+		if !ok || len(items) != dst.Len() {
+			return mismatch
+		}
+		for i, item := range items {
+			if err := assignMsgpack(dst.Index(i), item); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		pairs, ok := src.([]msgpackPair)
+		if !ok {
+			return mismatch
+		}
+		m := reflect.MakeMapWithSize(dst.Type(), len(pairs))
+		for _, pair := range pairs {
+			k := reflect.New(dst.Type().Key()).Elem()
+			if err := assignMsgpack(k, pair.key); err != nil {
+				return err
+			}
+			v := reflect.New(dst.Type().Elem()).Elem()
+			if err := assignMsgpack(v, pair.value); err != nil {
+				return err
+			}
+			m.SetMapIndex(k, v)
+		}
+		dst.Set(m)
+	case reflect.Struct:
+		pairs, ok := src.([]msgpackPair)
+		if !ok {
+			return mismatch
+		}
+		for _, pair := range pairs {
+			name, ok := pair.key.(string)
+			if !ok {
+				return mismatch
+			}
+			field, ok := dst.Type().FieldByName(name)
+			if !ok || !field.IsExported() {
+				continue
+			}
+			if err := assignMsgpack(dst.FieldByIndex(field.Index), pair.value); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	default:
+		return mismatch
+	}
+	return nil
+}
+
+// genericMsgpack turns decoded maps into map[string]any so values decoded
+// into an interface look like their encoding/json counterparts.
+func genericMsgpack(src any) any {
+	switch v := src.(type) {
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = genericMsgpack(item)
+		}
+		return out
+	case []msgpackPair:
+		out := make(map[string]any, len(v))
+		for _, pair := range v {
+			out[fmt.Sprint(pair.key)] = genericMsgpack(pair.value)
+		}
+		return out
+	}
+	return src
+}
@@ -0,0 +1,95 @@
+package pubsub
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type msgpackUnit struct {
+	ID   int
+	Rank string
+}
+
+type msgpackMove struct {
+	Player   string
+	Units    []msgpackUnit
+	Counts   map[string]int
+	Small    int8
+	Big      int64
+	Negative int
+	Unsigned uint32
+	Ratio    float64
+	Half     float32
+	Won      bool
+	Raw      []byte
+	Note     *string
+	Missing  *string
+	At       time.Time
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	note := "flanked"
+	in := msgpackMove{
+		Player:   "washington",
+		Units:    []msgpackUnit{{ID: 1, Rank: "infantry"}, {ID: 300, Rank: "artillery"}},
+		Counts:   map[string]int{"americas": 2, "europe": 70000},
+		Small:    -5,
+		Big:      math.MaxInt64,
+		Negative: -40000,
+		Unsigned: math.MaxUint32,
+		Ratio:    0.25,
+		Half:     1.5,
+		Won:      true,
+		Raw:      []byte{0, 1, 2, 255},
+		Note:     &note,
+		At:       time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC),
+	}
+	codec := MsgpackCodec{}
+	data, err := codec.Encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := Decode[msgpackMove](DefaultCodecs, codec.ContentType(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.At.Equal(in.At) {
+		t.Errorf("At = %v, want %v", out.At, in.At)
+	}
+	out.At = in.At
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+}
+
+func TestMsgpackLongValues(t *testing.T) {
+	long := make([]byte, 70000)
+	for i := range long {
+		long[i] = 'a' + byte(i%26)
+	}
+	in := map[string]any{"text": string(long)}
+	data, err := MsgpackCodec{}.Encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]any
+	if err := (MsgpackCodec{}).Decode(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["text"] != string(long) {
+		t.Errorf("long string did not round trip")
+	}
+}
+
+func TestMsgpackRejectsTruncatedData(t *testing.T) {
+	data, err := MsgpackCodec{}.Encode(msgpackUnit{ID: 7, Rank: "cavalry"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out msgpackUnit
+	if err := (MsgpackCodec{}).Decode(data[:len(data)-2], &out); err == nil {
+		t.Error("truncated data decoded without error")
+	}
+}
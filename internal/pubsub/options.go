@@ -0,0 +1,72 @@
+package pubsub
+
+import "log/slog"
+
+// DefaultPrefetch is how many unacknowledged messages a subscription may
+// hold when no option says otherwise.
+const DefaultPrefetch = 10
+
+// SubscribeOption tunes a single Subscribe call.
+type SubscribeOption func(*subscribeConfig)
+
+type subscribeConfig struct {
+	prefetch    int
+	concurrency int
+	keyOrdering bool
+	retry       *RetryPolicy
+	codecs      *CodecRegistry
+	dedup       DedupStore
+	verifier    Verifier
+	decryption  DecryptionKeys
+	// streamOffset is where a Stream subscription starts reading
+	streamOffset *StreamOffset
+	logger       *slog.Logger
+	// typed Middleware values, checked against T by subscribe
+	middleware []any
+}
+
+func newSubscribeConfig(opts []SubscribeOption) subscribeConfig {
+	cfg := subscribeConfig{prefetch: DefaultPrefetch, concurrency: 1, codecs: DefaultCodecs}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.concurrency < 1 {
+		cfg.concurrency = 1
+	}
+	// a worker without a message to work on is wasted
+	if cfg.prefetch < cfg.concurrency {
+		cfg.prefetch = cfg.concurrency
+	}
+	return cfg
+}
+
+// WithPrefetch sets the Qos prefetch count of the subscription's channel.
+func WithPrefetch(n int) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.prefetch = n
+	}
+}
+
+// WithConcurrency handles up to n messages at once. The prefetch count is
+// raised to at least n so every worker can be kept busy.
+func WithConcurrency(n int) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.concurrency = n
+	}
+}
+
+// WithKeyOrdering keeps messages with the same routing key in order while
+// still handling different keys concurrently.
+func WithKeyOrdering() SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.keyOrdering = true
+	}
+}
+
+// WithCodecs sets the codecs SubscribeByContentType picks from. The
+// default is DefaultCodecs.
+func WithCodecs(codecs *CodecRegistry) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.codecs = codecs
+	}
+}
@@ -0,0 +1,554 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrOutboxClosed = errors.New("pubsub: outbox is closed")
+
+// Reasons an Outbox drops a message without sending it. A message the
+// broker refused is dropped with the broker's last error.
+var (
+	ErrOutboxExpired      = errors.New("pubsub: message expired in the outbox")
+	ErrOutboxOtherSession = errors.New("pubsub: message was stored by an earlier session")
+)
+
+// OutboxDrop describes a message the outbox gave up on.
+type OutboxDrop struct {
+	Exchange string
+	Key      string
+	Msg      amqp.Publishing
+	Stored   time.Time
+	Reason   error
+}
+
+// outboxCompactEvery is how many sent records the file may collect before
+// it is rewritten with only the pending messages.
+const outboxCompactEvery = 1000
+
+// OutboxMaxAttempts is how often a message the broker refuses, as opposed
+// to one that could not reach it, is retried before it is dropped, so it
+// does not hold up the messages behind it forever.
+var OutboxMaxAttempts = 5
+
+// maxOutboxRecord bounds the size read for a record, so a damaged length
+// is not trusted.
+const maxOutboxRecord = 64 << 20
+
+// Outbox is a Publisher that writes messages to a file before they are
+// sent. A background loop publishes them to the target in order, retrying
+// with backoff until the target accepts each one, so messages published
+// while the broker is unreachable go out once it is back, also after a
+// restart. A message may be sent twice if the process dies right after
+// sending it; it keeps its message ID, so WithDedup consumers drop the copy.
+// Messages expire with their Expiration counted from when they were stored,
+// and messages stored in another session are dropped on load, as whatever
+// they announced is gone with that session. Whoever published a dropped
+// message learns of it through the dropped callback.
+type Outbox struct {
+	path    string
+	session string
+	target  Publisher
+	backoff Backoff
+	dropped func(OutboxDrop)
+
+	mu      sync.Mutex
+	file    *os.File
+	pending []outboxEntry
+	ids     map[string]bool
+	sent    int
+	closed  bool
+	empty   chan struct{}
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type outboxEntry struct {
+	Exchange  string
+	Key       string
+	Mandatory bool
+	Msg       amqp.Publishing
+	Session   string
+	Stored    time.Time
+}
+
+// expired reports whether e outlived its Expiration, and otherwise how
+// much of it is left.
+func (e outboxEntry) expired(now time.Time) (bool, time.Duration) {
+	if e.Msg.Expiration == "" {
+		return false, 0
+	}
+	ms, err := strconv.ParseInt(e.Msg.Expiration, 10, 64)
+	if err != nil {
+		return false, 0
+	}
+	left := e.Stored.Add(time.Duration(ms) * time.Millisecond).Sub(now)
+	return left <= 0, left
+}
+
+// outboxRecord is either a message to send or the ID of one that was sent.
+type outboxRecord struct {
+	Entry *outboxEntry
+	Sent  string
+}
+
+// NewOutbox loads the messages still pending in the file at path for
+// session and starts sending them to target. An empty session keeps the
+// messages of every session. dropped, if not nil, is called for every
+// message that is dropped instead of sent, from NewOutbox for those of the
+// file and from the sending goroutine later on.
+func NewOutbox(path string, target Publisher, session string, dropped func(OutboxDrop)) (*Outbox, error) {
+	o := &Outbox{
+		path:    path,
+		session: session,
+		target:  target,
+		backoff: DefaultBackoff,
+		dropped: dropped,
+		ids:     map[string]bool{},
+		empty:   make(chan struct{}),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	o.dropStale()
+	if err := o.compact(); err != nil {
+		return nil, err
+	}
+	if len(o.pending) > 0 {
+		Logger().Info("outbox has messages to send", "path", path, "pending", len(o.pending))
+	}
+	o.updateEmpty()
+	go o.run()
+	return o, nil
+}
+
+func (o *Outbox) load() error {
+	f, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not open outbox: %v", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		rec, err := readOutboxRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// a write cut short by a crash, everything before it is intact
+			Logger().Warn("outbox ends in a damaged record, ignoring it", "path", o.path, "error", err)
+			return nil
+		}
+		if rec.Entry != nil {
+			o.add(*rec.Entry)
+		} else {
+			o.remove(rec.Sent)
+		}
+	}
+}
+
+// dropStale drops loaded messages of other sessions and expired ones. It
+// runs after the whole file was read, so messages sent before their
+// session ended are not reported as dropped.
+func (o *Outbox) dropStale() {
+	now := time.Now()
+	var stale []OutboxDrop
+	for _, e := range slices.Clone(o.pending) {
+		var reason error
+		if o.session != "" && e.Session != o.session {
+			reason = ErrOutboxOtherSession
+		} else if expired, _ := e.expired(now); expired {
+			reason = ErrOutboxExpired
+		} else {
+			continue
+		}
+		Logger().Warn("outbox dropped message", "message_id", e.Msg.MessageId, "routing_key", e.Key, "reason", reason)
+		o.remove(e.Msg.MessageId)
+		stale = append(stale, e.drop(reason))
+	}
+	for _, d := range stale {
+		o.notifyDropped(d)
+	}
+}
+
+func (e outboxEntry) drop(reason error) OutboxDrop {
+	return OutboxDrop{Exchange: e.Exchange, Key: e.Key, Msg: e.Msg, Stored: e.Stored, Reason: reason}
+}
+
+func (o *Outbox) notifyDropped(d OutboxDrop) {
+	if o.dropped != nil {
+		o.dropped(d)
+	}
+}
+
+func (o *Outbox) add(e outboxEntry) {
+	if o.ids[e.Msg.MessageId] {
+		return
+	}
+	o.ids[e.Msg.MessageId] = true
+	o.pending = append(o.pending, e)
+}
+
+func (o *Outbox) remove(id string) {
+	if !o.ids[id] {
+		return
+	}
+	delete(o.ids, id)
+	for i, e := range o.pending {
+		if e.Msg.MessageId == id {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// compact rewrites the file with only the pending messages. If it fails
+// the current file stays in use.
+func (o *Outbox) compact() error {
+	var buf bytes.Buffer
+	for i := range o.pending {
+		if err := writeOutboxRecord(&buf, outboxRecord{Entry: &o.pending[i]}); err != nil {
+			return err
+		}
+	}
+	tmp := o.path + ".tmp"
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not write outbox: %v", err)
+	}
+	// opened before the rename, so the new file is never left without a
+	// handle to append to
+	f, err := os.OpenFile(tmp, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not open outbox: %v", err)
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("could not replace outbox: %v", err)
+	}
+	if o.file != nil {
+		o.file.Close()
+	}
+	o.file = f
+	o.sent = 0
+	outboxPending.With().Set(float64(len(o.pending)))
+	return nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// PublishWithContext stores msg to be sent. It returns once msg is on disk.
+func (o *Outbox) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.append([]outboxEntry{{Exchange: exchange, Key: key, Mandatory: mandatory, Msg: msg}})
+}
+
+// Do runs fn and stores what it publishes on its Publisher, all with one
+// write, only if fn succeeds. Calls to Do run one at a time, so a local
+// change made by fn and the messages announcing it are recorded in the same
+// order. If storing fails after fn succeeded, Do returns the error and the
+// caller has to undo fn's local change.
+func (o *Outbox) Do(fn func(ch Publisher) error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return ErrOutboxClosed
+	}
+	tx := &outboxTx{}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return o.append(tx.entries)
+}
+
+type outboxTx struct {
+	entries []outboxEntry
+}
+
+func (tx *outboxTx) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	tx.entries = append(tx.entries, outboxEntry{Exchange: exchange, Key: key, Mandatory: mandatory, Msg: msg})
+	return nil
+}
+
+// append writes entries and syncs the file before they are queued.
+func (o *Outbox) append(entries []outboxEntry) error {
+	if o.closed {
+		return ErrOutboxClosed
+	}
+	var buf bytes.Buffer
+	fresh := make([]outboxEntry, 0, len(entries))
+	now := time.Now()
+	for _, e := range entries {
+		e.Session = o.session
+		e.Stored = now
+		// the ID is what duplicates are recognised by
+		if e.Msg.MessageId == "" {
+			e.Msg.MessageId = NewMessageID()
+		}
+		if o.ids[e.Msg.MessageId] {
+			continue
+		}
+		if err := writeOutboxRecord(&buf, outboxRecord{Entry: &e}); err != nil {
+			return err
+		}
+		fresh = append(fresh, e)
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+	if _, err := o.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("could not write outbox: %w", err)
+	}
+	if err := o.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync outbox: %w", err)
+	}
+	for _, e := range fresh {
+		o.add(e)
+	}
+	outboxPending.With().Set(float64(len(o.pending)))
+	o.updateEmpty()
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (o *Outbox) run() {
+	defer close(o.stopped)
+	// refused counts the failures that were the message's fault
+	attempt, refused := 0, 0
+	for {
+		select {
+		case <-o.done:
+			return
+		default:
+		}
+		o.mu.Lock()
+		var next *outboxEntry
+		if len(o.pending) > 0 {
+			e := o.pending[0]
+			next = &e
+		}
+		o.mu.Unlock()
+		if next == nil {
+			select {
+			case <-o.wake:
+				continue
+			case <-o.done:
+				return
+			}
+		}
+
+		expired, left := next.expired(time.Now())
+		if expired {
+			Logger().Warn("outbox dropped expired message", "message_id", next.Msg.MessageId, "routing_key", next.Key)
+			attempt, refused = 0, 0
+			o.mu.Lock()
+			o.markSent(next.Msg.MessageId)
+			o.mu.Unlock()
+			o.notifyDropped(next.drop(ErrOutboxExpired))
+			continue
+		}
+		msg := next.Msg
+		if left > 0 {
+			// the time spent waiting counts against the message's TTL
+			msg.Expiration = strconv.FormatInt(max(left.Milliseconds(), 1), 10)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ConfirmTimeout)
+		err := o.target.PublishWithContext(ctx, next.Exchange, next.Key, next.Mandatory, false, msg)
+		cancel()
+		if err != nil && !unreachable(err) {
+			refused++
+		}
+		if err != nil && refused >= OutboxMaxAttempts {
+			Logger().Error("outbox gave up on message", "message_id", next.Msg.MessageId, "routing_key", next.Key, "attempts", refused, "error", err)
+			attempt, refused = 0, 0
+			o.mu.Lock()
+			o.markSent(next.Msg.MessageId)
+			o.mu.Unlock()
+			o.notifyDropped(next.drop(err))
+			continue
+		}
+		if err != nil {
+			delay := o.backoff.Delay(attempt)
+			attempt++
+			Logger().Warn("outbox could not send message, retrying", "message_id", next.Msg.MessageId, "routing_key", next.Key, "attempt", attempt, "retry_in", delay, "error", err)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-o.done:
+				return
+			}
+		}
+		attempt, refused = 0, 0
+		o.mu.Lock()
+		o.markSent(next.Msg.MessageId)
+		o.mu.Unlock()
+	}
+}
+
+// unreachable reports whether err is about the broker being away or busy
+// rather than about the message.
+func unreachable(err error) bool {
+	for _, target := range []error{ErrNotConnected, ErrBlocked, ErrRateLimited, ErrPoolClosed, amqp.ErrClosed, context.DeadlineExceeded} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// markSent drops a sent, expired or refused message. Losing the record only means sending the
+// message again, so it is not synced.
+func (o *Outbox) markSent(id string) {
+	o.remove(id)
+	outboxPending.With().Set(float64(len(o.pending)))
+	o.updateEmpty()
+	o.sent++
+	if len(o.pending) == 0 || o.sent >= outboxCompactEvery {
+		if err := o.compact(); err != nil {
+			Logger().Error("could not compact outbox", "path", o.path, "error", err)
+		}
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeOutboxRecord(&buf, outboxRecord{Sent: id}); err == nil {
+		if _, err := o.file.Write(buf.Bytes()); err != nil {
+			Logger().Error("could not write outbox", "path", o.path, "error", err)
+		}
+	}
+}
+
+// updateEmpty keeps o.empty closed exactly while nothing is pending.
+func (o *Outbox) updateEmpty() {
+	select {
+	case <-o.empty:
+		if len(o.pending) > 0 {
+			o.empty = make(chan struct{})
+		}
+	default:
+		if len(o.pending) == 0 {
+			close(o.empty)
+		}
+	}
+}
+
+// Pending is the number of messages not sent yet.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Flush waits until every message has been sent or ctx is done.
+func (o *Outbox) Flush(ctx context.Context) error {
+	o.mu.Lock()
+	empty := o.empty
+	o.mu.Unlock()
+	select {
+	case <-empty:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d messages still in the outbox: %w", o.Pending(), ctx.Err())
+	}
+}
+
+// Close stops sending. Messages not sent yet stay in the file for the
+// next NewOutbox.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil
+	}
+	o.closed = true
+	close(o.done)
+	o.mu.Unlock()
+	<-o.stopped
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.file.Close()
+}
+
+// Records are a length and a CRC-32 of the gob-encoded record, followed by
+// the record, so a record cut short by a crash is recognised.
+func writeOutboxRecord(w io.Writer, rec outboxRecord) error {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(rec); err != nil {
+		return fmt.Errorf("could not encode outbox record: %w", err)
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(body.Len()))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(body.Bytes()))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body.Bytes())
+	return err
+}
+
+func readOutboxRecord(r io.Reader) (outboxRecord, error) {
+	var rec outboxRecord
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return rec, errors.New("truncated record header")
+		}
+		return rec, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if int64(size) > maxOutboxRecord {
+		return rec, fmt.Errorf("record of %d bytes is too large", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return rec, errors.New("truncated record")
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		return rec, errors.New("checksum mismatch")
+	}
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&rec); err != nil {
+		return rec, err
+	}
+	return rec, nil
+}
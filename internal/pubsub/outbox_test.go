@@ -0,0 +1,220 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fastOutbox opens an outbox that retries with testBackoff.
+func fastOutbox(t *testing.T, path string, target Publisher, session string, dropped func(OutboxDrop)) *Outbox {
+	t.Helper()
+	saved := DefaultBackoff
+	DefaultBackoff = testBackoff
+	defer func() { DefaultBackoff = saved }()
+	o, err := NewOutbox(path, target, session, dropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.Close() })
+	return o
+}
+
+func flush(t *testing.T, o *Outbox) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := o.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutboxSendsInOrderOnceReachable(t *testing.T) {
+	target := &recordingPublisher{}
+	target.setFail(func(amqp.Publishing) error { return ErrNotConnected })
+	o := fastOutbox(t, filepath.Join(t.TempDir(), "outbox"), target, "s1", nil)
+	for _, key := range []string{"k.1", "k.2", "k.3"} {
+		if err := o.PublishWithContext(context.Background(), "x", key, false, false, amqp.Publishing{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if o.Pending() != 3 {
+		t.Fatalf("pending = %d while unreachable, want 3", o.Pending())
+	}
+	target.setFail(nil)
+	flush(t, o)
+	if got := target.sent(); !slices.Equal(got, []string{"k.1", "k.2", "k.3"}) {
+		t.Errorf("sent %v", got)
+	}
+}
+
+func TestOutboxKeepsMessagesOfSessionAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	down := &recordingPublisher{}
+	down.setFail(func(amqp.Publishing) error { return ErrNotConnected })
+	o := fastOutbox(t, path, down, "s1", nil)
+	if err := o.PublishWithContext(context.Background(), "x", "k.1", false, false, amqp.Publishing{MessageId: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+
+	target := &recordingPublisher{}
+	o = fastOutbox(t, path, target, "s1", nil)
+	flush(t, o)
+	if len(target.msgs) != 1 || target.msgs[0].MessageId != "m1" {
+		t.Fatalf("sent %+v after restart, want m1", target.msgs)
+	}
+}
+
+func TestOutboxDropsMessagesOfEarlierSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	down := &recordingPublisher{}
+	down.setFail(func(amqp.Publishing) error { return ErrNotConnected })
+	o := fastOutbox(t, path, down, "s1", nil)
+	if err := o.PublishWithContext(context.Background(), "x", "k.1", false, false, amqp.Publishing{}); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+
+	target := &recordingPublisher{}
+	o = fastOutbox(t, path, target, "s2", nil)
+	if o.Pending() != 0 {
+		t.Fatalf("pending = %d, messages of session s1 were kept", o.Pending())
+	}
+}
+
+func TestOutboxDropsExpiredMessages(t *testing.T) {
+	target := &recordingPublisher{}
+	target.setFail(func(amqp.Publishing) error { return ErrNotConnected })
+	o := fastOutbox(t, filepath.Join(t.TempDir(), "outbox"), target, "s1", nil)
+	if err := o.PublishWithContext(context.Background(), "x", "k.old", false, false, amqp.Publishing{Expiration: "20"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.PublishWithContext(context.Background(), "x", "k.new", false, false, amqp.Publishing{Expiration: "60000"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	target.setFail(nil)
+	flush(t, o)
+	if got := target.sent(); !slices.Equal(got, []string{"k.new"}) {
+		t.Fatalf("sent %v, want only k.new", got)
+	}
+	if exp := target.msgs[0].Expiration; exp == "60000" || exp == "" {
+		t.Errorf("expiration = %q, the time in the outbox was not taken off", exp)
+	}
+}
+
+func TestOutboxGivesUpOnRefusedMessage(t *testing.T) {
+	saved := OutboxMaxAttempts
+	OutboxMaxAttempts = 2
+	defer func() { OutboxMaxAttempts = saved }()
+	target := &recordingPublisher{}
+	target.setFail(func(msg amqp.Publishing) error {
+		if msg.MessageId == "poison" {
+			return ErrNacked
+		}
+		return nil
+	})
+	o := fastOutbox(t, filepath.Join(t.TempDir(), "outbox"), target, "s1", nil)
+	for _, id := range []string{"poison", "good"} {
+		if err := o.PublishWithContext(context.Background(), "x", "k."+id, false, false, amqp.Publishing{MessageId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flush(t, o)
+	if got := target.sent(); !slices.Equal(got, []string{"k.good"}) {
+		t.Fatalf("sent %v, want only k.good", got)
+	}
+}
+
+func TestOutboxDoStoresNothingWhenFnFails(t *testing.T) {
+	target := &recordingPublisher{}
+	o := fastOutbox(t, filepath.Join(t.TempDir(), "outbox"), target, "s1", nil)
+	failed := errors.New("invalid move")
+	err := o.Do(func(tx Publisher) error {
+		if err := tx.PublishWithContext(context.Background(), "x", "k.1", false, false, amqp.Publishing{}); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("Do = %v, want %v", err, failed)
+	}
+	if o.Pending() != 0 || len(target.sent()) != 0 {
+		t.Fatal("a failed Do stored its messages")
+	}
+}
+
+func TestOutboxUsableAfterFailedCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	target := &recordingPublisher{}
+	o := fastOutbox(t, path, target, "s1", nil)
+	// the temporary file cannot be created where a directory is
+	if err := os.Mkdir(path+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	o.mu.Lock()
+	err := o.compact()
+	o.mu.Unlock()
+	if err == nil {
+		t.Fatal("compact succeeded without its temporary file")
+	}
+	if err := o.PublishWithContext(context.Background(), "x", "k.1", false, false, amqp.Publishing{}); err != nil {
+		t.Fatalf("publish after failed compaction: %v", err)
+	}
+	flush(t, o)
+	if got := target.sent(); !slices.Equal(got, []string{"k.1"}) {
+		t.Fatalf("sent %v", got)
+	}
+}
+
+func TestOutboxReportsDroppedMessages(t *testing.T) {
+	saved := OutboxMaxAttempts
+	OutboxMaxAttempts = 1
+	defer func() { OutboxMaxAttempts = saved }()
+	path := filepath.Join(t.TempDir(), "outbox")
+	down := &recordingPublisher{}
+	down.setFail(func(amqp.Publishing) error { return ErrNotConnected })
+	o := fastOutbox(t, path, down, "s1", nil)
+	if err := o.PublishWithContext(context.Background(), "x", "k.old", false, false, amqp.Publishing{MessageId: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+
+	dropped := make(chan OutboxDrop, 3)
+	target := &recordingPublisher{}
+	target.setFail(func(msg amqp.Publishing) error {
+		if msg.MessageId == "poison" {
+			return ErrNacked
+		}
+		return ErrNotConnected
+	})
+	o = fastOutbox(t, path, target, "s2", func(d OutboxDrop) { dropped <- d })
+	for _, msg := range []amqp.Publishing{{MessageId: "poison"}, {MessageId: "late", Expiration: "20"}} {
+		if err := o.PublishWithContext(context.Background(), "x", "k."+msg.MessageId, false, false, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]error{"old": ErrOutboxOtherSession, "poison": ErrNacked, "late": ErrOutboxExpired}
+	for range want {
+		select {
+		case d := <-dropped:
+			if reason, ok := want[d.Msg.MessageId]; !ok || !errors.Is(d.Reason, reason) || d.Key != "k."+d.Msg.MessageId {
+				t.Errorf("dropped %s (%s) because %v", d.Msg.MessageId, d.Key, d.Reason)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("drop was not reported")
+		}
+	}
+	if o.Pending() != 0 {
+		t.Errorf("pending = %d after every message was dropped", o.Pending())
+	}
+}
@@ -0,0 +1,93 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DefaultPoolSize is how many channels a PublisherPool opens when asked
+// for fewer than one.
+const DefaultPoolSize = 4
+
+var ErrPoolClosed = errors.New("pubsub: publisher pool is closed")
+
+// PublisherPool is a Publisher that can be shared by any number of
+// goroutines. An amqp channel must not be published on concurrently, so the
+// pool owns several confirm-mode channels and lends each to one publish at
+// a time. A channel that fails is replaced on its next use. Pass it to
+// PublishJSON, PublishGob or any Publisher wrapper like a channel.
+type PublisherPool struct {
+	idle chan *ConfirmedPublisher
+	size int
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+// NewPublisherPool opens size confirm-mode channels on conn, see
+// NewConfirmedPublisher for mandatory.
+func NewPublisherPool(conn Broker, size int, mandatory bool) (*PublisherPool, error) {
+	if size < 1 {
+		size = DefaultPoolSize
+	}
+	p := &PublisherPool{idle: make(chan *ConfirmedPublisher, size), size: size, done: make(chan struct{})}
+	for i := 0; i < size; i++ {
+		pub, err := NewConfirmedPublisher(conn, mandatory)
+		if err != nil {
+			close(p.idle)
+			for opened := range p.idle {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("could not open publisher channel: %w", err)
+		}
+		p.idle <- pub
+	}
+	return p, nil
+}
+
+func (p *PublisherPool) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ConfirmTimeout)
+		defer cancel()
+	}
+	select {
+	case <-p.done:
+		return ErrPoolClosed
+	default:
+	}
+	var pub *ConfirmedPublisher
+	select {
+	case pub = <-p.idle:
+	case <-p.done:
+		return ErrPoolClosed
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for a publisher channel: %w", ctx.Err())
+	}
+	defer func() { p.idle <- pub }()
+	return pub.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// Close waits for publishes in flight and closes every channel.
+func (p *PublisherPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	p.mu.Unlock()
+
+	var errs []error
+	for i := 0; i < p.size; i++ {
+		pub := <-p.idle
+		errs = append(errs, pub.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -1,65 +1,83 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"time"
 
-	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func EncodeGob(gl routing.GameLog) ([]byte, error) {
-	var network bytes.Buffer
-	enc := gob.NewEncoder(&network)
-	err := enc.Encode(gl)
-	if err != nil {
-		return nil, err
-	}
-	return network.Bytes(), nil
+func EncodeGob[T any](val T) ([]byte, error) {
+	return GobCodec{}.Encode(val)
 }
 
-func DecodeGob(data []byte) (routing.GameLog, error) {
-	var gl routing.GameLog
-	dec := gob.NewDecoder(bytes.NewBuffer(data))
-	err := dec.Decode(&gl)
-	if err != nil {
-		return routing.GameLog{}, err
-	}
-	return gl, nil
+func DecodeGob[T any](data []byte) (T, error) {
+	var val T
+	err := GobCodec{}.Decode(data, &val)
+	return val, err
 }
+
 func DecodeJSON[T any](data []byte) (T, error) {
 	var msgUnmarshaled T
 	if err := json.Unmarshal(data, &msgUnmarshaled); err != nil {
-		fmt.Printf("Error unmarshalling message: %v\n", err)
-		// Handle error (maybe reject the message or log it)
 		return msgUnmarshaled, err
 	}
 	return msgUnmarshaled, nil
 }
 
-func PublishGob(ch *amqp.Channel, exchange, key string, val routing.GameLog) error {
+// Publish encodes val with codec and publishes it with the codec's
+// content type.
+func Publish[T any](ch Publisher, codec Codec, exchange, key string, val T) error {
+	return PublishContext(context.Background(), ch, codec, exchange, key, val)
+}
 
-	bytes, err := EncodeGob(val)
+// PublishContext is Publish with a context, e.g. a deadline up to which a
+// FlowControl publisher waits while the broker blocks publishers.
+func PublishContext[T any](ctx context.Context, ch Publisher, codec Codec, exchange, key string, val T) error {
+	bytes, err := codec.Encode(val)
 	if err != nil {
+		return fmt.Errorf("could not encode %s message: %w", codec.ContentType(), err)
+	}
+	parent, _ := tracing.ParseTraceParent(traceParentOf(ch))
+	span := tracing.Start("publish "+exchange, tracing.KindProducer, parent)
+	span.SetAttr("messaging.destination.name", exchange)
+	span.SetAttr("messaging.rabbitmq.destination.routing_key", key)
+	defer span.Finish()
+	msg := amqp.Publishing{
+		ContentType: codec.ContentType(),
+		Body:        bytes,
+		Headers:     amqp.Table{TraceParentHeader: span.Context.TraceParent()},
+	}
+	stamp(&msg, val)
+	span.SetAttr("messaging.message.id", msg.MessageId)
+	if err := ch.PublishWithContext(ctx, exchange, key, false, false, msg); err != nil {
+		span.SetError(err)
 		return err
 	}
-	ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{ContentType: "application/gob", Body: bytes})
+	recordPublished(exchange, key)
 	return nil
 }
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	bytes, err := json.Marshal(val)
 
-	// Fatal error (prints and exits)
-	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return err
-	}
+func PublishGob[T any](ch Publisher, exchange, key string, val T) error {
+	return Publish(ch, GobCodec{}, exchange, key, val)
+}
 
-	ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{ContentType: "application/json", Body: bytes})
-	return nil
+func PublishJSON[T any](ch Publisher, exchange, key string, val T) error {
+	return Publish(ch, JSONCodec{}, exchange, key, val)
+}
+
+func PublishGobContext[T any](ctx context.Context, ch Publisher, exchange, key string, val T) error {
+	return PublishContext(ctx, ch, GobCodec{}, exchange, key, val)
+}
+
+func PublishJSONContext[T any](ctx context.Context, ch Publisher, exchange, key string, val T) error {
+	return PublishContext(ctx, ch, JSONCodec{}, exchange, key, val)
 }
 
 type SimpleQueueType int
@@ -67,19 +85,30 @@ type SimpleQueueType int
 const (
 	Durable   SimpleQueueType = iota
 	Transient SimpleQueueType = iota
+	// Quorum queues are replicated across nodes, so they survive a node
+	// failure. Messages requeued more than DefaultDeliveryLimit times are
+	// dead-lettered.
+	Quorum
+	// Stream queues keep messages after they are consumed, so subscribers
+	// can replay them from any offset, see WithStreamOffset.
+	Stream
 )
 
 func DeclareAndBind(
-	conn *amqp.Connection,
+	conn Broker,
 	exchange,
 	queueName,
 	key string,
-	simpleQueueType SimpleQueueType, // an enum to represent "durable" or "transient"
-	table amqp.Table) (*amqp.Channel, amqp.Queue, error) {
+	simpleQueueType SimpleQueueType, // an enum to represent "durable", "transient", "quorum" or "stream"
+	table amqp.Table) (Channel, amqp.Queue, error) {
 
-	channel, _ := conn.Channel()
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, amqp.Queue{}, fmt.Errorf("error ocured when opening a channel,\n%v", err)
+	}
 
-	queue, err := channel.QueueDeclare(queueName, simpleQueueType == Durable, simpleQueueType == Transient, simpleQueueType == Transient, false, table)
+	durable, autoDelete, exclusive := simpleQueueType.flags()
+	queue, err := channel.QueueDeclare(queueName, durable, autoDelete, exclusive, false, simpleQueueType.args(table))
 	if err != nil {
 		return nil, amqp.Queue{}, fmt.Errorf("error ocured when declaring a queue. quename: %s,\n%v", queueName, err)
 	}
@@ -88,14 +117,82 @@ func DeclareAndBind(
 	return channel, queue, err
 }
 
+// inProgressDelay is how long a copy of a message that another worker is
+// handling waits before it is requeued.
+var inProgressDelay = time.Second
+
 type MessageProcessor[T any] struct {
-	handler       func(T) Acktype
-	decodeHandler func([]byte) (T, error)
+	handler       Handler[T]
+	decodeHandler func(amqp.Delivery) (T, error)
+	concurrency   int
+	keyOrdering   bool
+	retrier       *retrier
+	dedup         DedupStore
+	verifier      Verifier
+	decryption    DecryptionKeys
+	logger        *slog.Logger
+	// queue labels the processor's metrics
+	queue string
 }
 
 func NewMessageProcessor[T any](handler func(T) Acktype,
 	decodeHandler func([]byte) (T, error)) *MessageProcessor[T] {
-	return &MessageProcessor[T]{handler: handler, decodeHandler: decodeHandler}
+	return NewMetadataProcessor(withoutMetadata(handler), decodeHandler)
+}
+
+// NewMetadataProcessor is NewMessageProcessor for handlers that also want
+// the message's envelope.
+func NewMetadataProcessor[T any](handler func(T, Metadata) Acktype,
+	decodeHandler func([]byte) (T, error)) *MessageProcessor[T] {
+	return NewHandlerProcessor(withoutContext(handler), decodeHandler)
+}
+
+// NewHandlerProcessor is NewMessageProcessor for context-aware handlers.
+func NewHandlerProcessor[T any](handler Handler[T],
+	decodeHandler func([]byte) (T, error)) *MessageProcessor[T] {
+	decode := func(msg amqp.Delivery) (T, error) {
+		return decodeHandler(msg.Body)
+	}
+	return &MessageProcessor[T]{handler: handler, decodeHandler: decode, concurrency: 1}
+}
+
+func withoutMetadata[T any](handler func(T) Acktype) func(T, Metadata) Acktype {
+	return func(val T, _ Metadata) Acktype {
+		return handler(val)
+	}
+}
+
+func withoutContext[T any](handler func(T, Metadata) Acktype) Handler[T] {
+	return func(_ context.Context, val T, meta Metadata) Acktype {
+		return handler(val, meta)
+	}
+}
+
+// NewContentTypeProcessor decodes every message with the codec matching
+// its content type.
+func NewContentTypeProcessor[T any](handler func(T) Acktype, codecs *CodecRegistry) *MessageProcessor[T] {
+	return &MessageProcessor[T]{handler: withoutContext(withoutMetadata(handler)), decodeHandler: decodeByContentType[T](codecs), concurrency: 1}
+}
+
+func decodeByContentType[T any](codecs *CodecRegistry) func(amqp.Delivery) (T, error) {
+	return func(msg amqp.Delivery) (T, error) {
+		return Decode[T](codecs, msg.ContentType, msg.Body)
+	}
+}
+
+// SetConcurrency makes ProcessDeliveries use n workers. With keyOrdering,
+// messages sharing a routing key always go to the same worker.
+func (mp *MessageProcessor[T]) SetConcurrency(n int, keyOrdering bool) {
+	if n < 1 {
+		n = 1
+	}
+	mp.concurrency = n
+	mp.keyOrdering = keyOrdering
+}
+
+// Use wraps the handler in mws, the first being the outermost.
+func (mp *MessageProcessor[T]) Use(mws ...Middleware[T]) {
+	mp.handler = Chain(mws...)(mp.handler)
 }
 
 type Acktype int
@@ -104,78 +201,297 @@ const (
 	Ack         Acktype = iota
 	NackRequeue Acktype = iota
 	NackDiscard Acktype = iota
+	// NackRetry redelivers the message after a delay, see WithRetry.
+	// Without a retry policy it behaves like NackRequeue.
+	NackRetry Acktype = iota
 )
 
+func (a Acktype) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "nack-requeue"
+	case NackDiscard:
+		return "nack-discard"
+	case NackRetry:
+		return "nack-retry"
+	default:
+		return fmt.Sprintf("Acktype(%d)", int(a))
+	}
+}
+
 func (mp *MessageProcessor[T]) ProcessMessage(msg amqp.Delivery) {
-	fmt.Printf("Received a message\n")
-	fmt.Println("Unmarshalling...")
-	msgUnmarshaled, err := mp.decodeHandler(msg.Body)
+	log := messageLogger(mp.log(), msg)
+	log.Debug("message received")
+	labels := []string{msg.Exchange, mp.queue, routingPrefix(msg.RoutingKey)}
+	inFlight.With(labels...).Inc()
+	defer inFlight.With(labels...).Dec()
+	meta := MetadataFrom(msg)
+	parent, _ := tracing.ParseTraceParent(meta.TraceParent)
+	span := tracing.Start("process "+mp.queue, tracing.KindConsumer, parent)
+	span.SetAttr("messaging.destination.name", msg.Exchange)
+	span.SetAttr("messaging.rabbitmq.destination.routing_key", msg.RoutingKey)
+	span.SetAttr("messaging.message.id", msg.MessageId)
+	if meta.Sender != "" {
+		span.SetAttr("peril.username", meta.Sender)
+	}
+	defer span.Finish()
+	meta.TraceParent = span.Context.TraceParent()
+	ctx := tracing.ContextWithSpan(context.Background(), span)
+
+	if mp.verifier != nil {
+		if err := Verify(msg, mp.verifier); err != nil {
+			log.Warn("rejected message with invalid signature", "error", err)
+			signatureFailuresTotal.With(labels...).Inc()
+			span.SetError(err)
+			msg.Nack(false, false)
+			return
+		}
+		meta.Verified = true
+	}
+	ack := NackDiscard
+	if mp.dedup != nil && msg.MessageId != "" {
+		switch mp.dedup.Claim(msg.MessageId) {
+		case AlreadyProcessed:
+			log.Info("duplicate message skipped")
+			duplicatesTotal.With(labels...).Inc()
+			span.SetAttr("peril.ack", "duplicate")
+			if err := msg.Ack(false); err != nil {
+				log.Error("could not ack message", "error", err)
+			}
+			return
+		case InProgress:
+			// another worker has it. Requeueing right away would bounce
+			// the copy between broker and consumer until that worker is
+			// done, so it is held back for a while first
+			log.Debug("duplicate message in progress, requeueing later", "delay", inProgressDelay)
+			time.AfterFunc(inProgressDelay, func() {
+				if err := msg.Nack(false, true); err != nil {
+					log.Error("could not requeue message", "error", err)
+				}
+			})
+			return
+		}
+		defer func() {
+			// requeued and retried messages have to be handled again
+			processed := ack == Ack || ack == NackDiscard
+			if err := mp.dedup.Release(msg.MessageId, processed); err != nil {
+				log.Error("could not record processed message", "error", err)
+			}
+		}()
+	}
+	// retries and dead letters keep the body as it was published
+	decoded, err := Decrypt(msg, mp.decryption)
+	if err == nil {
+		decoded, err = Decompress(decoded)
+	}
+	var msgUnmarshaled T
+	if err == nil {
+		msgUnmarshaled, err = mp.decodeHandler(decoded)
+	}
 	if err != nil {
-		fmt.Printf("Error unmarshalling message: %v\n", err)
-		// Handle error (maybe reject the message or log it)
+		log.Error("could not decode message", "content_type", msg.ContentType, "content_encoding", msg.ContentEncoding, "error", err)
+		decodeFailuresTotal.With(labels...).Inc()
+		span.SetError(err)
 		msg.Nack(false, false)
 		return
 	}
-	ack := mp.handler(msgUnmarshaled)
+	start := time.Now()
+	ack = mp.handler(ctx, msgUnmarshaled, meta)
+	observeHandler(start, labels...)
+	recordAck(ack, labels...)
+	span.SetAttr("peril.ack", ack.String())
 	switch ack {
 	case Ack:
-		err := msg.Ack(false)
-		if err != nil {
-			fmt.Println("error!", err)
-		} else {
-			fmt.Println("Ack fired.")
-		}
+		err = msg.Ack(false)
 	case NackRequeue:
-		err := msg.Nack(false, true)
-		if err != nil {
-			fmt.Println("error!", err)
-		} else {
-			fmt.Println("NackR fired.")
-		}
+		err = msg.Nack(false, true)
 	case NackDiscard:
-		err := msg.Nack(false, false)
-
-		if err != nil {
-			fmt.Println("error!", err)
-		} else {
-			fmt.Println("NackD fired.")
+		err = msg.Nack(false, false)
+	case NackRetry:
+		if mp.retrier == nil {
+			log.Warn("no retry policy, requeueing message")
+			err = msg.Nack(false, true)
+			break
 		}
+		if err := mp.retrier.retry(msg); err != nil {
+			log.Error("could not schedule retry", "error", err)
+			msg.Nack(false, true)
+			return
+		}
+		log.Debug("retry scheduled", "attempt", RetryCount(msg)+1)
+		err = msg.Ack(false)
+	}
+	if err != nil {
+		log.Error("could not acknowledge message", "ack", ack.String(), "error", err)
 	}
-	// msg.Ack(false)
 }
 
-func (mp *MessageProcessor[T]) ProcessDeliveries(deliveries <-chan amqp.Delivery) {
-	go func() {
-		for msg := range deliveries {
+func (mp *MessageProcessor[T]) log() *slog.Logger {
+	if mp.logger != nil {
+		return mp.logger
+	}
+	return Logger()
+}
+
+// ProcessDeliveries handles deliveries in the background. The returned
+// channel is closed once deliveries is closed and the last message handled.
+func (mp *MessageProcessor[T]) ProcessDeliveries(deliveries <-chan amqp.Delivery) <-chan struct{} {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	worker := func(msgs <-chan amqp.Delivery) {
+		defer wg.Done()
+		for msg := range msgs {
 			mp.ProcessMessage(msg)
 		}
+	}
+
+	wg.Add(mp.concurrency)
+	if mp.keyOrdering && mp.concurrency > 1 {
+		shards := make([]chan amqp.Delivery, mp.concurrency)
+		for i := range shards {
+			shards[i] = make(chan amqp.Delivery)
+			go worker(shards[i])
+		}
+		go func() {
+			for msg := range deliveries {
+				h := fnv.New32a()
+				h.Write([]byte(msg.RoutingKey))
+				shards[h.Sum32()%uint32(len(shards))] <- msg
+			}
+			for _, shard := range shards {
+				close(shard)
+			}
+		}()
+	} else {
+		for i := 0; i < mp.concurrency; i++ {
+			go worker(deliveries)
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
 	}()
+	return done
 }
 
+// Subscribe declares and binds queueName and hands every message to
+// handler in the background until the returned Subscription is closed.
+// No middleware is installed by default: a handler that panics takes the
+// program down unless it is wrapped in Recover with WithMiddleware.
 func Subscribe[T any](
-	conn *amqp.Connection,
+	conn Broker,
 	exchange, queueName, key string,
 	simpleQueueType SimpleQueueType,
 	handler func(T) Acktype,
 	decodeHandler func([]byte) (T, error),
-	table amqp.Table) error {
+	table amqp.Table,
+	opts ...SubscribeOption) (*Subscription, error) {
+	return subscribe(conn, exchange, queueName, key, simpleQueueType, NewMessageProcessor(handler, decodeHandler), table, newSubscribeConfig(opts))
+}
+
+// SubscribeWithMetadata is Subscribe for handlers that also want the
+// message's envelope, e.g. to publish follow-up messages with CausedBy.
+func SubscribeWithMetadata[T any](
+	conn Broker,
+	exchange, queueName, key string,
+	simpleQueueType SimpleQueueType,
+	handler func(T, Metadata) Acktype,
+	decodeHandler func([]byte) (T, error),
+	table amqp.Table,
+	opts ...SubscribeOption) (*Subscription, error) {
+	return subscribe(conn, exchange, queueName, key, simpleQueueType, NewMetadataProcessor(handler, decodeHandler), table, newSubscribeConfig(opts))
+}
+
+// SubscribeHandler is Subscribe for context-aware handlers, which can
+// honour deadlines set by middleware such as Timeout.
+func SubscribeHandler[T any](
+	conn Broker,
+	exchange, queueName, key string,
+	simpleQueueType SimpleQueueType,
+	handler Handler[T],
+	decodeHandler func([]byte) (T, error),
+	table amqp.Table,
+	opts ...SubscribeOption) (*Subscription, error) {
+	return subscribe(conn, exchange, queueName, key, simpleQueueType, NewHandlerProcessor(handler, decodeHandler), table, newSubscribeConfig(opts))
+}
+
+// SubscribeByContentType is Subscribe with the decoder chosen per message
+// from its content type (see WithCodecs), so producers can switch formats
+// without their consumers being redeployed first.
+func SubscribeByContentType[T any](
+	conn Broker,
+	exchange, queueName, key string,
+	simpleQueueType SimpleQueueType,
+	handler func(T) Acktype,
+	table amqp.Table,
+	opts ...SubscribeOption) (*Subscription, error) {
+	cfg := newSubscribeConfig(opts)
+	return subscribe(conn, exchange, queueName, key, simpleQueueType, NewContentTypeProcessor(handler, cfg.codecs), table, cfg)
+}
+
+func subscribe[T any](
+	conn Broker,
+	exchange, queueName, key string,
+	simpleQueueType SimpleQueueType,
+	processor *MessageProcessor[T],
+	table amqp.Table,
+	cfg subscribeConfig) (*Subscription, error) {
+	mws, err := middlewareFor[T](cfg.middleware)
+	if err != nil {
+		return nil, err
+	}
+	processor.Use(mws...)
 	channel, queue, err := DeclareAndBind(conn, exchange, queueName, key, simpleQueueType, table)
 	if err != nil {
-		return fmt.Errorf("error occured when declare and bind\n%v", err)
+		return nil, fmt.Errorf("error occured when declare and bind\n%v", err)
 	}
 
+	log := cfg.logger
+	if log == nil {
+		log = Logger()
+	}
+	log = log.With(slog.String("exchange", exchange), slog.String("queue", queue.Name))
+
 	// Do prefetch here
-	err = channel.Qos(10, 0, false)
+	err = channel.Qos(cfg.prefetch, 0, false)
 	if err != nil {
-		fmt.Printf("Eror when declaring Qos\nerr:%v\n", err)
+		log.Warn("could not set prefetch", "prefetch", cfg.prefetch, "error", err)
 	}
-	deliveryChan, err := channel.Consume(queue.Name, "", false, false, false, false, nil)
+	consumeArgs, err := simpleQueueType.consumeArgs(cfg.streamOffset)
 	if err != nil {
-		return fmt.Errorf("error when chanel was created\n%v", err)
+		channel.Close()
+		return nil, err
+	}
+	var retry *retrier
+	if cfg.retry != nil {
+		if simpleQueueType == Stream {
+			channel.Close()
+			return nil, fmt.Errorf("cannot retry messages of stream %s, it keeps them anyway", queue.Name)
+		}
+		durable, _, _ := simpleQueueType.flags()
+		retry, err = declareRetryQueues(conn, channel, queue.Name, durable, *cfg.retry, cfg.concurrency)
+		if err != nil {
+			channel.Close()
+			return nil, err
+		}
+	}
+	consumer := queue.Name
+	deliveryChan, err := channel.Consume(queue.Name, consumer, false, false, false, false, consumeArgs)
+	if err != nil {
+		retry.close()
+		channel.Close()
+		return nil, fmt.Errorf("error when chanel was created\n%v", err)
 	}
 
-	processor := NewMessageProcessor(handler, decodeHandler)
-	processor.ProcessDeliveries(deliveryChan)
-
-	return nil
+	processor.SetConcurrency(cfg.concurrency, cfg.keyOrdering)
+	processor.retrier = retry
+	processor.dedup = cfg.dedup
+	processor.verifier = cfg.verifier
+	processor.decryption = cfg.decryption
+	processor.logger = log
+	processor.queue = queue.Name
+	return newSubscription(channel, consumer, retry.closeAfter(processor.ProcessDeliveries(deliveryChan))), nil
 }
@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Overflow is what a queue at its maximum length does with new messages.
+type Overflow string
+
+const (
+	// OverflowDropHead drops, or dead-letters, the oldest messages.
+	OverflowDropHead Overflow = "drop-head"
+	// OverflowRejectPublish refuses new messages; confirmed publishers see
+	// them nacked.
+	OverflowRejectPublish Overflow = "reject-publish"
+	// OverflowRejectPublishDLX refuses new messages and dead-letters them.
+	OverflowRejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// QueueOptions are the queue arguments pubsub knows about. Table turns them
+// into the amqp.Table DeclareAndBind and Subscribe take; zero values are
+// left out.
+type QueueOptions struct {
+	// MessageTTL dead-letters, or drops, messages that waited this long.
+	MessageTTL time.Duration
+	// Expires deletes the queue after it went unused this long.
+	Expires time.Duration
+	// MaxLength and MaxLengthBytes bound the ready messages, Overflow says
+	// what happens beyond them.
+	MaxLength      int
+	MaxLengthBytes int
+	Overflow       Overflow
+	// MaxPriority enables message priorities 0 to MaxPriority, see
+	// MessageOptions. Only classic queues support it.
+	MaxPriority uint8
+	// Lazy keeps messages on disk. RabbitMQ 3.12 and later ignore it, as
+	// all classic queues behave that way.
+	Lazy bool
+
+	DeadLetterExchange   string
+	DeadLetterRoutingKey string
+}
+
+func (o QueueOptions) Table() amqp.Table {
+	table := amqp.Table{}
+	if o.MessageTTL > 0 {
+		table["x-message-ttl"] = o.MessageTTL.Milliseconds()
+	}
+	if o.Expires > 0 {
+		table["x-expires"] = o.Expires.Milliseconds()
+	}
+	if o.MaxLength > 0 {
+		table["x-max-length"] = int64(o.MaxLength)
+	}
+	if o.MaxLengthBytes > 0 {
+		table["x-max-length-bytes"] = int64(o.MaxLengthBytes)
+	}
+	if o.Overflow != "" {
+		table["x-overflow"] = string(o.Overflow)
+	}
+	if o.MaxPriority > 0 {
+		table["x-max-priority"] = int64(o.MaxPriority)
+	}
+	if o.Lazy {
+		table["x-queue-mode"] = "lazy"
+	}
+	if o.DeadLetterExchange != "" {
+		table["x-dead-letter-exchange"] = o.DeadLetterExchange
+	}
+	if o.DeadLetterRoutingKey != "" {
+		table["x-dead-letter-routing-key"] = o.DeadLetterRoutingKey
+	}
+	if len(table) == 0 {
+		return nil
+	}
+	return table
+}
+
+// MessageOptions sets the expiration and priority of messages published
+// through its Publisher, unless they already have one.
+type MessageOptions struct {
+	// Expiration dead-letters, or drops, a message not consumed in time.
+	Expiration time.Duration
+	// Priority orders messages in queues declared with a MaxPriority.
+	Priority uint8
+}
+
+func (o MessageOptions) Publisher(ch Publisher) Publisher {
+	return &optionsPublisher{wrapper: wrapper{ch}, options: o}
+}
+
+type optionsPublisher struct {
+	wrapper
+	options MessageOptions
+}
+
+func (p *optionsPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if msg.Expiration == "" && p.options.Expiration > 0 {
+		msg.Expiration = strconv.FormatInt(p.options.Expiration.Milliseconds(), 10)
+	}
+	if msg.Priority == 0 {
+		msg.Priority = p.options.Priority
+	}
+	return p.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
@@ -0,0 +1,62 @@
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestQueueOptionsTable(t *testing.T) {
+	got := QueueOptions{
+		MessageTTL:           90 * time.Second,
+		Expires:              time.Hour,
+		MaxLength:            1000,
+		MaxLengthBytes:       1 << 20,
+		Overflow:             OverflowRejectPublishDLX,
+		MaxPriority:          5,
+		Lazy:                 true,
+		DeadLetterExchange:   "peril_dlx",
+		DeadLetterRoutingKey: "dead",
+	}.Table()
+	want := amqp.Table{
+		"x-message-ttl":             int64(90000),
+		"x-expires":                 int64(3600000),
+		"x-max-length":              int64(1000),
+		"x-max-length-bytes":        int64(1 << 20),
+		"x-overflow":                "reject-publish-dlx",
+		"x-max-priority":            int64(5),
+		"x-queue-mode":              "lazy",
+		"x-dead-letter-exchange":    "peril_dlx",
+		"x-dead-letter-routing-key": "dead",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Table() = %v, want %v", got, want)
+	}
+	if err := got.Validate(); err != nil {
+		t.Errorf("table is not valid AMQP: %v", err)
+	}
+	if table := (QueueOptions{}).Table(); table != nil {
+		t.Errorf("zero options give %v, want nil", table)
+	}
+}
+
+func TestMessageOptionsKeepExplicitValues(t *testing.T) {
+	target := &recordingPublisher{}
+	pub := MessageOptions{Expiration: 1500 * time.Millisecond, Priority: 3}.Publisher(target)
+	publish := func(msg amqp.Publishing) amqp.Publishing {
+		t.Helper()
+		if err := pub.PublishWithContext(context.Background(), "x", "k.a", false, false, msg); err != nil {
+			t.Fatal(err)
+		}
+		return target.msgs[len(target.msgs)-1]
+	}
+	if msg := publish(amqp.Publishing{}); msg.Expiration != "1500" || msg.Priority != 3 {
+		t.Errorf("expiration %q, priority %d", msg.Expiration, msg.Priority)
+	}
+	if msg := publish(amqp.Publishing{Expiration: "10", Priority: 9}); msg.Expiration != "10" || msg.Priority != 9 {
+		t.Errorf("message's own expiration %q and priority %d were replaced", msg.Expiration, msg.Priority)
+	}
+}
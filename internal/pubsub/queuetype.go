@@ -0,0 +1,98 @@
+package pubsub
+
+import (
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DefaultDeliveryLimit is how often a Quorum queue redelivers a message
+// before dead-lettering it, unless the queue's table sets x-delivery-limit.
+const DefaultDeliveryLimit = 20
+
+func (t SimpleQueueType) String() string {
+	switch t {
+	case Durable:
+		return "durable"
+	case Transient:
+		return "transient"
+	case Quorum:
+		return "quorum"
+	case Stream:
+		return "stream"
+	}
+	return fmt.Sprintf("SimpleQueueType(%d)", int(t))
+}
+
+// flags are the QueueDeclare flags of t. Quorum queues and streams are
+// always durable and can be neither exclusive nor auto-deleted.
+func (t SimpleQueueType) flags() (durable, autoDelete, exclusive bool) {
+	if t == Transient {
+		return false, true, true
+	}
+	return true, false, false
+}
+
+// args adds the x-queue-type argument of t, and the default delivery limit
+// of a quorum queue, to the caller's table.
+func (t SimpleQueueType) args(table amqp.Table) amqp.Table {
+	if t != Quorum && t != Stream {
+		return table
+	}
+	args := copyTable(table)
+	args["x-queue-type"] = t.String()
+	if _, ok := args["x-delivery-limit"]; t == Quorum && !ok {
+		args["x-delivery-limit"] = int64(DefaultDeliveryLimit)
+	}
+	return args
+}
+
+func (t SimpleQueueType) consumeArgs(offset *StreamOffset) (amqp.Table, error) {
+	if t != Stream {
+		if offset != nil {
+			return nil, fmt.Errorf("stream offset set for a %s queue", t)
+		}
+		return nil, nil
+	}
+	if offset == nil {
+		return nil, nil
+	}
+	return amqp.Table{"x-stream-offset": offset.value}, nil
+}
+
+// StreamOffset is where a subscription to a Stream starts reading.
+// Without one it reads only messages published after it subscribed.
+type StreamOffset struct {
+	value any
+}
+
+var (
+	// StreamFirst replays everything the stream still holds.
+	StreamFirst = StreamOffset{"first"}
+	// StreamLast starts at the last chunk of messages written.
+	StreamLast = StreamOffset{"last"}
+	// StreamNext starts after the newest message.
+	StreamNext = StreamOffset{"next"}
+)
+
+// StreamFrom starts at the messages written at or after t. Streams store
+// messages in chunks, so a few earlier messages may be delivered too.
+func StreamFrom(t time.Time) StreamOffset {
+	return StreamOffset{t}
+}
+
+// StreamAt starts at a numeric offset, e.g. one after the last message a
+// subscriber handled, from the x-stream-offset header of its deliveries.
+func StreamAt(offset int64) StreamOffset {
+	return StreamOffset{offset}
+}
+
+// WithStreamOffset sets where a subscription to a Stream starts reading.
+// Stream messages are never removed by acknowledgements, so a NackRequeue
+// or NackDiscard has no effect on them.
+func WithStreamOffset(offset StreamOffset) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.streamOffset = &offset
+	}
+}
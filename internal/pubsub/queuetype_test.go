@@ -0,0 +1,71 @@
+package pubsub
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestQueueTypeArgs(t *testing.T) {
+	dlx := amqp.Table{"x-dead-letter-exchange": "dlx"}
+	for _, tt := range []struct {
+		name  string
+		typ   SimpleQueueType
+		table amqp.Table
+		want  amqp.Table
+	}{
+		{"durable", Durable, dlx, dlx},
+		{"transient", Transient, nil, nil},
+		{"quorum", Quorum, nil, amqp.Table{"x-queue-type": "quorum", "x-delivery-limit": int64(DefaultDeliveryLimit)}},
+		{"quorum with table", Quorum, dlx, amqp.Table{"x-queue-type": "quorum", "x-delivery-limit": int64(DefaultDeliveryLimit), "x-dead-letter-exchange": "dlx"}},
+		{"quorum with own limit", Quorum, amqp.Table{"x-delivery-limit": int64(3)}, amqp.Table{"x-queue-type": "quorum", "x-delivery-limit": int64(3)}},
+		{"stream", Stream, nil, amqp.Table{"x-queue-type": "stream"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.typ.args(tt.table); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("args = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if len(dlx) != 1 {
+		t.Errorf("caller's table was changed: %v", dlx)
+	}
+}
+
+func TestQuorumDeliveryLimitDeadLetters(t *testing.T) {
+	mem := newTopicBroker(t)
+	if err := DeclareDeadLetter(mem, "dlx", "dead"); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := mem.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	dead, err := ch.Consume("dead", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int32
+	table := amqp.Table{"x-dead-letter-exchange": "dlx", "x-delivery-limit": int64(2)}
+	sub, err := Subscribe(mem, "x", "q", "k.*", Quorum, func(string) Acktype {
+		calls.Add(1)
+		return NackRequeue
+	}, DecodeJSON, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSub(t, sub)
+	if err := PublishJSON(ch, "x", "k.a", "poison"); err != nil {
+		t.Fatal(err)
+	}
+	if dl := NewDeadLetter(receive(t, dead)); dl.Reason != "delivery_limit" || dl.Queue != "q" {
+		t.Errorf("dead-lettered from %q as %q, want from q as delivery_limit", dl.Queue, dl.Reason)
+	}
+	// the first delivery and two redeliveries
+	if n := calls.Load(); n != 3 {
+		t.Errorf("handled %d times, want 3", n)
+	}
+}
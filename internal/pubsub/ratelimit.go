@@ -0,0 +1,245 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrRateLimited is returned for publishes beyond their RateLimit.
+var ErrRateLimited = errors.New("pubsub: publish rate limit exceeded")
+
+// RateLimit allows Rate messages per second on average and bursts of up to
+// Burst messages. A Rate of zero or less does not limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// tokenBucket starts full and earns Rate tokens per second up to Burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: limit.burst(), last: now}
+}
+
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	b.tokens = min(limit.burst(), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+}
+
+// allow takes a token if there is one.
+func (b *tokenBucket) allow(limit RateLimit, now time.Time) bool {
+	b.refill(limit, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve takes a token even if there is none yet and returns how long it
+// takes to earn it.
+func (b *tokenBucket) reserve(limit RateLimit, now time.Time) time.Duration {
+	b.refill(limit, now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / limit.Rate * float64(time.Second))
+}
+
+// RateLimiter holds publishers to a RateLimit per routing prefix, e.g.
+// "game_logs" for every game_logs.<username> key. Prefixes without a limit
+// are not limited.
+type RateLimiter struct {
+	limits map[string]RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func NewRateLimiter(limits map[string]RateLimit) *RateLimiter {
+	return &RateLimiter{limits: limits, buckets: map[string]*tokenBucket{}}
+}
+
+// reserve takes a token for prefix. cancel gives it back if the publish
+// does not happen after all.
+func (l *RateLimiter) reserve(prefix string, limit RateLimit) (wait time.Duration, cancel func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[prefix]
+	if !ok {
+		b = newTokenBucket(limit, now)
+		l.buckets[prefix] = b
+	}
+	return b.reserve(limit, now), func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		b.tokens = min(limit.burst(), b.tokens+1)
+	}
+}
+
+// Publisher checks l before every publish on ch. A publish beyond the limit
+// waits for its turn up to maxWait or its context's deadline, whichever
+// comes first, and fails with ErrRateLimited if its turn is later; with a
+// zero maxWait and no deadline it fails right away.
+func (l *RateLimiter) Publisher(ch Publisher, maxWait time.Duration) Publisher {
+	return &rateLimitedPublisher{wrapper: wrapper{ch}, limiter: l, maxWait: maxWait}
+}
+
+type rateLimitedPublisher struct {
+	wrapper
+	limiter *RateLimiter
+	maxWait time.Duration
+}
+
+func (p *rateLimitedPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	prefix := routingPrefix(key)
+	limit, ok := p.limiter.limits[prefix]
+	if !ok || limit.Rate <= 0 {
+		return p.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	}
+	wait, cancel := p.limiter.reserve(prefix, limit)
+	if wait > 0 {
+		allowed := p.maxWait
+		if deadline, ok := ctx.Deadline(); ok && (allowed == 0 || time.Until(deadline) < allowed) {
+			allowed = time.Until(deadline)
+		}
+		if wait > allowed {
+			cancel()
+			publishRateLimitedTotal.With(exchange, prefix).Inc()
+			return fmt.Errorf("%w: %s allows %g per second, next in %v", ErrRateLimited, prefix, limit.Rate, wait.Round(time.Millisecond))
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			cancel()
+			return fmt.Errorf("%w: %w", ErrRateLimited, ctx.Err())
+		}
+	}
+	return p.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// Quota tracks the rate of received messages per sender and routing
+// prefix, so a player ignoring its RateLimit is noticed by consumers. See
+// Enforce.
+type Quota struct {
+	limits map[string]RateLimit
+
+	mu        sync.Mutex
+	buckets   map[quotaKey]*tokenBucket
+	offenders map[quotaKey]*Offender
+}
+
+type quotaKey struct {
+	sender, prefix string
+}
+
+// Offender is a sender that went over its quota.
+type Offender struct {
+	Sender        string
+	RoutingPrefix string
+	// Dropped is how many messages were beyond the quota.
+	Dropped     int
+	First, Last time.Time
+}
+
+func NewQuota(limits map[string]RateLimit) *Quota {
+	return &Quota{limits: limits, buckets: map[quotaKey]*tokenBucket{}, offenders: map[quotaKey]*Offender{}}
+}
+
+// Allow reports whether sender may send another message on key. Messages
+// it refuses are counted against the sender.
+func (q *Quota) Allow(sender, key string) bool {
+	prefix := routingPrefix(key)
+	limit, ok := q.limits[prefix]
+	if !ok || limit.Rate <= 0 {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	id := quotaKey{sender, prefix}
+	b, ok := q.buckets[id]
+	if !ok {
+		b = newTokenBucket(limit, now)
+		q.buckets[id] = b
+	}
+	if b.allow(limit, now) {
+		return true
+	}
+	quotaExceededTotal.With(prefix).Inc()
+	o, ok := q.offenders[id]
+	if !ok {
+		o = &Offender{Sender: sender, RoutingPrefix: prefix, First: now}
+		q.offenders[id] = o
+		Logger().Warn("sender is over its message quota", "sender", sender, "routing_prefix", prefix, "rate", limit.Rate, "burst", limit.burst())
+	}
+	o.Dropped++
+	o.Last = now
+	return false
+}
+
+// Offenders returns the senders that went over their quota since the last
+// call, most dropped messages first, and starts over. Senders back to a
+// full bucket are forgotten.
+func (q *Quota) Offenders() []Offender {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for id, b := range q.buckets {
+		limit := q.limits[id.prefix]
+		b.refill(limit, now)
+		if b.tokens >= limit.burst() {
+			delete(q.buckets, id)
+		}
+	}
+	offenders := make([]Offender, 0, len(q.offenders))
+	for _, o := range q.offenders {
+		offenders = append(offenders, *o)
+	}
+	q.offenders = map[quotaKey]*Offender{}
+	sort.Slice(offenders, func(i, j int) bool {
+		return offenders[i].Dropped > offenders[j].Dropped
+	})
+	return offenders
+}
+
+// Enforce hands messages beyond q to over instead of the handler: Ack
+// only counts them, NackDiscard drops them, or dead-letters them if the
+// queue has a dead-letter exchange. Only senders verified by WithVerifier
+// get a quota of their own, unverified messages share one, so nobody can
+// use up another player's quota by naming them.
+func Enforce[T any](q *Quota, over Acktype) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(ctx context.Context, val T, meta Metadata) Acktype {
+			sender := meta.Sender
+			if !meta.Verified {
+				sender = ""
+			}
+			if !q.Allow(sender, meta.RoutingKey) {
+				return over
+			}
+			return next(ctx, val, meta)
+		}
+	}
+}
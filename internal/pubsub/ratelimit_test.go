@@ -0,0 +1,80 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRateLimiterRefusesBeyondBurst(t *testing.T) {
+	target := &recordingPublisher{}
+	limiter := NewRateLimiter(map[string]RateLimit{"army_moves": {Rate: 1, Burst: 2}})
+	pub := limiter.Publisher(target, 0)
+	for i := 0; i < 2; i++ {
+		if err := pub.PublishWithContext(context.Background(), "x", "army_moves.a", false, false, amqp.Publishing{}); err != nil {
+			t.Fatalf("publish %d within burst: %v", i, err)
+		}
+	}
+	err := pub.PublishWithContext(context.Background(), "x", "army_moves.a", false, false, amqp.Publishing{})
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("publish beyond burst = %v, want ErrRateLimited", err)
+	}
+	// other prefixes are not limited
+	if err := pub.PublishWithContext(context.Background(), "x", "game_logs.a", false, false, amqp.Publishing{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(target.sent()); got != 3 {
+		t.Errorf("sent %d messages, want 3", got)
+	}
+}
+
+func TestRateLimiterWaitsForItsTurn(t *testing.T) {
+	target := &recordingPublisher{}
+	limiter := NewRateLimiter(map[string]RateLimit{"army_moves": {Rate: 50, Burst: 1}})
+	pub := limiter.Publisher(target, time.Second)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := pub.PublishWithContext(context.Background(), "x", "army_moves.a", false, false, amqp.Publishing{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("3 publishes at 50/s took %v, the limiter did not wait", elapsed)
+	}
+}
+
+func TestQuotaPerSender(t *testing.T) {
+	q := NewQuota(map[string]RateLimit{"army_moves": {Rate: 1, Burst: 1}})
+	if !q.Allow("alice", "army_moves.alice") {
+		t.Fatal("first message refused")
+	}
+	if q.Allow("alice", "army_moves.alice") {
+		t.Fatal("message beyond quota allowed")
+	}
+	if !q.Allow("bob", "army_moves.bob") {
+		t.Fatal("alice used up bob's quota")
+	}
+	offenders := q.Offenders()
+	if len(offenders) != 1 || offenders[0].Sender != "alice" || offenders[0].Dropped != 1 {
+		t.Fatalf("offenders = %+v", offenders)
+	}
+}
+
+func TestEnforceIgnoresUnverifiedSenders(t *testing.T) {
+	q := NewQuota(map[string]RateLimit{"army_moves": {Rate: 1, Burst: 1}})
+	handler := Enforce[string](q, NackDiscard)(func(context.Context, string, Metadata) Acktype {
+		return Ack
+	})
+	forged := Metadata{Sender: "alice", RoutingKey: "army_moves.alice"}
+	handler(context.Background(), "", forged)
+	if got := handler(context.Background(), "", forged); got != NackDiscard {
+		t.Fatalf("second unverified message = %v, want NackDiscard", got)
+	}
+	verified := Metadata{Sender: "alice", RoutingKey: "army_moves.alice", Verified: true}
+	if got := handler(context.Background(), "", verified); got != Ack {
+		t.Fatalf("forged messages used up alice's quota: %v", got)
+	}
+}
@@ -0,0 +1,744 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrNotConnected = errors.New("pubsub: not connected to the broker")
+
+// Backoff is an exponential delay that starts at Min and doubles up to Max.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+var DefaultBackoff = Backoff{Min: 500 * time.Millisecond, Max: 30 * time.Second}
+
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := b.Min
+	for i := 0; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// ManagedConnection is a Broker that survives broker restarts. It watches
+// the underlying connection, redials with backoff when it closes, replays
+// every exchange, queue and binding declared through its channels and
+// resumes their consumers on the new connection.
+//
+// Queues declared with an empty (server-generated) name are not replayed.
+type ManagedConnection struct {
+	dial    func() (Broker, error)
+	backoff Backoff
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	broker   Broker
+	gen      int
+	topology []declaration
+	channels map[*managedChannel]struct{}
+	notify   []chan *amqp.Error
+	closed   bool
+	done     chan struct{}
+
+	// blockedMu guards the NotifyBlocked listeners, which are sent to
+	// without holding mu
+	blockedMu    sync.Mutex
+	blocked      []chan amqp.Blocking
+	blockedState amqp.Blocking
+	blockedDone  bool
+}
+
+type declaration struct {
+	key   string
+	apply func(Channel) error
+}
+
+func NewManagedConnection(dial func() (Broker, error), backoff Backoff) (*ManagedConnection, error) {
+	b, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	m := &ManagedConnection{
+		dial:     dial,
+		backoff:  backoff,
+		broker:   b,
+		gen:      1,
+		channels: map[*managedChannel]struct{}{},
+		done:     make(chan struct{}),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	go m.forwardBlocked(b.NotifyBlocked(make(chan amqp.Blocking, 1)))
+	go m.watch(b)
+	return m, nil
+}
+
+func DialManaged(url string) (*ManagedConnection, error) {
+	return NewManagedConnection(func() (Broker, error) { return Dial(url) }, DefaultBackoff)
+}
+
+func (m *ManagedConnection) watch(b Broker) {
+	for {
+		reason, ok := <-b.NotifyClose(make(chan *amqp.Error, 1))
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return
+		}
+		m.broker = nil
+		m.mu.Unlock()
+		if ok {
+			Logger().Warn("connection lost, reconnecting", "error", reason)
+		} else {
+			Logger().Warn("connection closed, reconnecting")
+		}
+
+		b = m.reconnect()
+		if b == nil {
+			return
+		}
+		Logger().Info("reconnected")
+		// a new connection starts unblocked and reports alarms anew
+		m.notifyBlocked(amqp.Blocking{Active: false})
+		go m.forwardBlocked(b.NotifyBlocked(make(chan amqp.Blocking, 1)))
+	}
+}
+
+// reconnect dials until it gets a connection with the recorded topology
+// restored. It returns nil if the ManagedConnection was closed meanwhile.
+func (m *ManagedConnection) reconnect() Broker {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-m.done:
+			return nil
+		case <-time.After(m.backoff.Delay(attempt)):
+		}
+		b, err := m.dial()
+		if err != nil {
+			Logger().Warn("reconnect attempt failed", "attempt", attempt+1, "error", err)
+			continue
+		}
+		if err := m.restore(b); err != nil {
+			Logger().Error("could not restore topology", "error", err)
+			b.Close()
+			continue
+		}
+		return b
+	}
+}
+
+func (m *ManagedConnection) restore(b Broker) error {
+	ch, err := b.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		b.Close()
+		return nil
+	}
+	for _, d := range m.topology {
+		if err := d.apply(ch); err != nil {
+			return fmt.Errorf("%s: %w", d.key, err)
+		}
+	}
+	m.broker = b
+	m.gen++
+	m.cond.Broadcast()
+	return nil
+}
+
+func (m *ManagedConnection) record(key string, apply func(Channel) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.topology {
+		if d.key == key {
+			return
+		}
+	}
+	m.topology = append(m.topology, declaration{key: key, apply: apply})
+}
+
+// current returns the live broker and its generation. If minGen is above
+// zero it waits until a connection of at least that generation is up.
+func (m *ManagedConnection) current(minGen int) (Broker, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for minGen > 0 && !m.closed && (m.broker == nil || m.gen < minGen) {
+		m.cond.Wait()
+	}
+	if m.closed {
+		return nil, 0, amqp.ErrClosed
+	}
+	if m.broker == nil {
+		return nil, 0, ErrNotConnected
+	}
+	return m.broker, m.gen, nil
+}
+
+// Channel returns a channel that transparently moves to the new connection
+// after a reconnect.
+func (m *ManagedConnection) Channel() (Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, amqp.ErrClosed
+	}
+	mc := &managedChannel{conn: m, done: make(chan struct{}), cancelled: map[string]bool{}}
+	m.channels[mc] = struct{}{}
+	return mc, nil
+}
+
+// NotifyClose is only triggered by Close; lost connections are recovered.
+func (m *ManagedConnection) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		close(c)
+		return c
+	}
+	m.notify = append(m.notify, c)
+	return c
+}
+
+// NotifyBlocked reports alarms of whichever connection is current.
+func (m *ManagedConnection) NotifyBlocked(c chan amqp.Blocking) chan amqp.Blocking {
+	m.blockedMu.Lock()
+	defer m.blockedMu.Unlock()
+	if m.blockedDone {
+		close(c)
+		return c
+	}
+	m.blocked = append(m.blocked, c)
+	return c
+}
+
+func (m *ManagedConnection) forwardBlocked(notifications chan amqp.Blocking) {
+	for blocking := range notifications {
+		m.notifyBlocked(blocking)
+	}
+}
+
+func (m *ManagedConnection) notifyBlocked(blocking amqp.Blocking) {
+	m.blockedMu.Lock()
+	defer m.blockedMu.Unlock()
+	if m.blockedDone || blocking.Active == m.blockedState.Active {
+		return
+	}
+	m.blockedState = blocking
+	for _, c := range m.blocked {
+		c <- blocking
+	}
+}
+
+func (m *ManagedConnection) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	m.closed = true
+	close(m.done)
+	m.cond.Broadcast()
+	b := m.broker
+	channels := m.channels
+	m.channels = nil
+	for _, c := range m.notify {
+		close(c)
+	}
+	m.notify = nil
+	m.mu.Unlock()
+
+	m.blockedMu.Lock()
+	m.blockedDone = true
+	for _, c := range m.blocked {
+		close(c)
+	}
+	m.blocked = nil
+	m.blockedMu.Unlock()
+
+	for mc := range channels {
+		mc.Close()
+	}
+	if b == nil {
+		return nil
+	}
+	return b.Close()
+}
+
+type managedChannel struct {
+	conn *ManagedConnection
+	done chan struct{}
+
+	mu        sync.Mutex
+	ch        Channel
+	gen       int
+	qos       *[3]int
+	cancelled map[string]bool
+	notify    []chan *amqp.Error
+	closed    bool
+	seq       int
+
+	// confirm mode and the NotifyPublish and NotifyReturn listeners carry
+	// over to every new underlying channel. Delivery tags restart at 1 on
+	// each, so they are shifted by the publishes made on the earlier ones.
+	confirm   bool
+	published uint64
+	confirms  []chan amqp.Confirmation
+	returns   []chan amqp.Return
+	cancels   []chan string
+	// sendMu is held while notifying listeners so Close does not close
+	// them under a send
+	sendMu sync.Mutex
+}
+
+// raw returns the underlying channel for the current connection, opening
+// one if the connection changed or the channel closed since it was last
+// used.
+func (mc *managedChannel) raw(minGen int) (Channel, int, error) {
+	b, gen, err := mc.conn.current(minGen)
+	if err != nil {
+		return nil, 0, err
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed {
+		return nil, 0, amqp.ErrClosed
+	}
+	if mc.ch != nil && mc.gen == gen {
+		return mc.ch, gen, nil
+	}
+	ch, err := b.Channel()
+	if err != nil {
+		return nil, 0, err
+	}
+	if mc.qos != nil {
+		if err := ch.Qos(mc.qos[0], mc.qos[1], mc.qos[2] != 0); err != nil {
+			ch.Close()
+			return nil, 0, err
+		}
+	}
+	if mc.confirm {
+		if err := ch.Confirm(false); err != nil {
+			ch.Close()
+			return nil, 0, err
+		}
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	go mc.forward(ch, mc.published, confirms, returns)
+	mc.ch, mc.gen = ch, gen
+	return ch, gen, nil
+}
+
+// forward passes ch's confirms and returns on to the listeners until ch
+// closes, and then forgets ch so the next use opens a new channel, also
+// while the connection stays up.
+func (mc *managedChannel) forward(ch Channel, base uint64, confirms chan amqp.Confirmation, returns chan amqp.Return) {
+	defer mc.forget(ch)
+	for confirms != nil || returns != nil {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			mc.sendReturn(ret)
+		case conf, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			// the broker sends a return before the confirm of the same
+			// message, keep that order
+		drain:
+			for returns != nil {
+				select {
+				case ret, ok := <-returns:
+					if !ok {
+						returns = nil
+						break drain
+					}
+					mc.sendReturn(ret)
+				default:
+					break drain
+				}
+			}
+			conf.DeliveryTag += base
+			mc.sendConfirm(conf)
+		}
+	}
+}
+
+func (mc *managedChannel) sendConfirm(conf amqp.Confirmation) {
+	mc.mu.Lock()
+	listeners := mc.confirms
+	mc.mu.Unlock()
+	mc.sendMu.Lock()
+	defer mc.sendMu.Unlock()
+	for _, c := range listeners {
+		select {
+		case c <- conf:
+		case <-mc.done:
+			return
+		}
+	}
+}
+
+func (mc *managedChannel) sendReturn(ret amqp.Return) {
+	mc.mu.Lock()
+	listeners := mc.returns
+	mc.mu.Unlock()
+	mc.sendMu.Lock()
+	defer mc.sendMu.Unlock()
+	for _, c := range listeners {
+		select {
+		case c <- ret:
+		case <-mc.done:
+			return
+		}
+	}
+}
+
+// forget drops ch if it is still the current channel.
+func (mc *managedChannel) forget(ch Channel) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.ch == ch {
+		mc.ch = nil
+	}
+}
+
+// reset forgets ch after it failed so the next call opens a fresh one.
+func (mc *managedChannel) reset(ch Channel, err error) {
+	var amqpErr *amqp.Error
+	if err == nil || !errors.As(err, &amqpErr) {
+		return
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.ch == ch {
+		mc.ch = nil
+	}
+}
+
+func (mc *managedChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch, _, err := mc.raw(0)
+	if err != nil {
+		return err
+	}
+	err = ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	mc.reset(ch, err)
+	if err == nil {
+		mc.mu.Lock()
+		if mc.ch == ch && mc.confirm {
+			mc.published++
+		}
+		mc.mu.Unlock()
+	}
+	return err
+}
+
+func (mc *managedChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	apply := func(ch Channel) error {
+		return ch.ExchangeDeclare(name, kind, durable, autoDelete, internal, noWait, args)
+	}
+	ch, _, err := mc.raw(0)
+	if err != nil {
+		return err
+	}
+	if err := apply(ch); err != nil {
+		mc.reset(ch, err)
+		return err
+	}
+	mc.conn.record(fmt.Sprintf("exchange %s %s", name, kind), apply)
+	return nil
+}
+
+func (mc *managedChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch, _, err := mc.raw(0)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	queue, err := ch.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+	if err != nil {
+		mc.reset(ch, err)
+		return queue, err
+	}
+	if name != "" {
+		mc.conn.record(fmt.Sprintf("queue %s", name), func(ch Channel) error {
+			_, err := ch.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+			return err
+		})
+	}
+	return queue, nil
+}
+
+func (mc *managedChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	apply := func(ch Channel) error {
+		return ch.QueueBind(name, key, exchange, noWait, args)
+	}
+	ch, _, err := mc.raw(0)
+	if err != nil {
+		return err
+	}
+	if err := apply(ch); err != nil {
+		mc.reset(ch, err)
+		return err
+	}
+	mc.conn.record(fmt.Sprintf("binding %s %s %s", exchange, key, name), apply)
+	return nil
+}
+
+func (mc *managedChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	ch, _, err := mc.raw(0)
+	if err != nil {
+		return err
+	}
+	if err := ch.Qos(prefetchCount, prefetchSize, global); err != nil {
+		mc.reset(ch, err)
+		return err
+	}
+	g := 0
+	if global {
+		g = 1
+	}
+	mc.mu.Lock()
+	mc.qos = &[3]int{prefetchCount, prefetchSize, g}
+	mc.mu.Unlock()
+	return nil
+}
+
+// Consume returns a delivery channel that keeps delivering across
+// reconnects until the consumer is cancelled or the channel is closed.
+func (mc *managedChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	if consumer == "" {
+		mc.mu.Lock()
+		mc.seq++
+		consumer = fmt.Sprintf("peril-%p-%d", mc, mc.seq)
+		mc.mu.Unlock()
+	}
+	ch, gen, err := mc.raw(0)
+	if err != nil {
+		return nil, err
+	}
+	cancels, closes := watchConsumer(ch)
+	deliveries, err := ch.Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+	if err != nil {
+		mc.reset(ch, err)
+		return nil, err
+	}
+
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+		for {
+			for d := range deliveries {
+				out <- d
+			}
+			if mc.stopped(consumer) {
+				return
+			}
+			// a consumer the broker cancelled on a live channel stays
+			// cancelled, only a lost channel or connection is resumed
+			if cancelled(consumer, cancels, closes) {
+				mc.sendCancel(consumer)
+				return
+			}
+			for {
+				if mc.stopped(consumer) {
+					return
+				}
+				next, nextGen, err := mc.raw(gen)
+				if err == nil {
+					cancels, closes = watchConsumer(next)
+					deliveries, err = next.Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+					if err == nil {
+						gen = nextGen
+						break
+					}
+					mc.reset(next, err)
+					Logger().Error("could not resume consumer", "queue", queue, "error", err)
+				}
+				time.Sleep(mc.conn.backoff.Min)
+			}
+		}
+	}()
+	return out, nil
+}
+
+// watchConsumer listens for ch cancelling consumers and closing, to tell
+// why a consumer on it stopped.
+func watchConsumer(ch Channel) (chan string, chan *amqp.Error) {
+	return ch.NotifyCancel(make(chan string, 16)), ch.NotifyClose(make(chan *amqp.Error, 1))
+}
+
+// cancelled waits for the reason a consumer's deliveries ended: true if
+// the broker cancelled it, false if its channel closed.
+func cancelled(consumer string, cancels chan string, closes chan *amqp.Error) bool {
+	for {
+		select {
+		case tag, ok := <-cancels:
+			if !ok {
+				return false
+			}
+			if tag == consumer {
+				return true
+			}
+		case <-closes:
+			return false
+		}
+	}
+}
+
+// sendCancel tells the NotifyCancel listeners the broker cancelled
+// consumer.
+func (mc *managedChannel) sendCancel(consumer string) {
+	mc.mu.Lock()
+	listeners := mc.cancels
+	mc.mu.Unlock()
+	mc.sendMu.Lock()
+	defer mc.sendMu.Unlock()
+	for _, c := range listeners {
+		select {
+		case c <- consumer:
+		case <-mc.done:
+			return
+		}
+	}
+}
+
+func (mc *managedChannel) stopped(consumer string) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.closed || mc.cancelled[consumer]
+}
+
+func (mc *managedChannel) Cancel(consumer string, noWait bool) error {
+	mc.mu.Lock()
+	mc.cancelled[consumer] = true
+	ch := mc.ch
+	mc.mu.Unlock()
+	if ch == nil {
+		return nil
+	}
+	return ch.Cancel(consumer, noWait)
+}
+
+// Confirm puts the channel in confirm mode, including the channels opened
+// after a reconnect. Publishes that were not confirmed when their channel
+// closed are never confirmed.
+func (mc *managedChannel) Confirm(noWait bool) error {
+	ch, _, err := mc.raw(0)
+	if err != nil {
+		return err
+	}
+	if err := ch.Confirm(noWait); err != nil {
+		mc.reset(ch, err)
+		return err
+	}
+	mc.mu.Lock()
+	mc.confirm = true
+	mc.mu.Unlock()
+	return nil
+}
+
+// NotifyPublish and NotifyReturn listeners stay registered across
+// reconnects and are closed by Close.
+func (mc *managedChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed {
+		close(confirm)
+		return confirm
+	}
+	mc.confirms = append(mc.confirms, confirm)
+	return confirm
+}
+
+func (mc *managedChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed {
+		close(c)
+		return c
+	}
+	mc.returns = append(mc.returns, c)
+	return c
+}
+
+// NotifyCancel listeners hear of consumers the broker cancelled on any
+// underlying channel, and are closed by Close.
+func (mc *managedChannel) NotifyCancel(c chan string) chan string {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed {
+		close(c)
+		return c
+	}
+	mc.cancels = append(mc.cancels, c)
+	return c
+}
+
+func (mc *managedChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed {
+		close(c)
+		return c
+	}
+	mc.notify = append(mc.notify, c)
+	return c
+}
+
+func (mc *managedChannel) Close() error {
+	mc.mu.Lock()
+	if mc.closed {
+		mc.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	mc.closed = true
+	close(mc.done)
+	ch := mc.ch
+	mc.ch = nil
+	for _, c := range mc.notify {
+		close(c)
+	}
+	mc.notify = nil
+	confirms, returns, cancels := mc.confirms, mc.returns, mc.cancels
+	mc.confirms, mc.returns, mc.cancels = nil, nil, nil
+	mc.mu.Unlock()
+
+	mc.sendMu.Lock()
+	for _, c := range confirms {
+		close(c)
+	}
+	for _, c := range returns {
+		close(c)
+	}
+	for _, c := range cancels {
+		close(c)
+	}
+	mc.sendMu.Unlock()
+
+	mc.conn.mu.Lock()
+	delete(mc.conn.channels, mc)
+	mc.conn.mu.Unlock()
+	if ch == nil {
+		return nil
+	}
+	return ch.Close()
+}
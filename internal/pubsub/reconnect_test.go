@@ -0,0 +1,243 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// dropConn is one connection to a shared MemoryBroker, so the broker and
+// its queues outlive a dropped connection the way RabbitMQ's do.
+type dropConn struct {
+	broker *MemoryBroker
+
+	mu       sync.Mutex
+	channels []Channel
+	notify   []chan *amqp.Error
+	closed   bool
+}
+
+func (c *dropConn) Channel() (Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch, err := c.broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+	c.channels = append(c.channels, ch)
+	return ch, nil
+}
+
+func (c *dropConn) NotifyClose(n chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		close(n)
+		return n
+	}
+	c.notify = append(c.notify, n)
+	return n
+}
+
+func (c *dropConn) NotifyBlocked(n chan amqp.Blocking) chan amqp.Blocking {
+	return c.broker.NotifyBlocked(n)
+}
+
+func (c *dropConn) Close() error {
+	c.drop(nil)
+	return nil
+}
+
+// drop closes every channel of the connection and reports reason.
+func (c *dropConn) drop(reason *amqp.Error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for _, ch := range c.channels {
+		ch.Close()
+	}
+	for _, n := range c.notify {
+		if reason != nil {
+			n <- reason
+		}
+		close(n)
+	}
+}
+
+// dropper dials dropConns to one MemoryBroker and remembers the last.
+type dropper struct {
+	broker *MemoryBroker
+
+	mu   sync.Mutex
+	last *dropConn
+}
+
+func (d *dropper) dial() (Broker, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.last = &dropConn{broker: d.broker}
+	return d.last, nil
+}
+
+func (d *dropper) drop() {
+	d.mu.Lock()
+	last := d.last
+	d.mu.Unlock()
+	last.drop(&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"})
+}
+
+func newDropper(t *testing.T) (*dropper, *ManagedConnection) {
+	t.Helper()
+	d := &dropper{broker: NewMemoryBroker()}
+	m, err := NewManagedConnection(d.dial, testBackoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return d, m
+}
+
+// waitGen waits until m is on a connection newer than gen.
+func waitGen(t *testing.T, m *ManagedConnection, gen int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		m.mu.Lock()
+		now, up := m.gen, m.broker != nil
+		m.mu.Unlock()
+		if up && now > gen {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("no reconnect")
+}
+
+func TestManagedConsumerResumesAfterReconnect(t *testing.T) {
+	d, m := newDropper(t)
+	ch, _ := m.Channel()
+	declareQueue(t, ch, "q")
+	deliveries, err := ch.Consume("q", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.drop()
+	waitGen(t, m, 1)
+	pub, _ := m.Channel()
+	if err := pub.PublishWithContext(context.Background(), "x", "k.a", false, false, amqp.Publishing{Body: []byte("after")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, deliveries); string(got.Body) != "after" {
+		t.Fatalf("got %q", got.Body)
+	}
+}
+
+func TestManagedConsumerSurvivesChannelClose(t *testing.T) {
+	_, m := newDropper(t)
+	ch, _ := m.Channel()
+	declareQueue(t, ch, "q")
+	deliveries, err := ch.Consume("q", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a channel-level error closes only the channel, the connection stays
+	mc := ch.(*managedChannel)
+	mc.mu.Lock()
+	raw := mc.ch
+	mc.mu.Unlock()
+	raw.Close()
+
+	pub, _ := m.Channel()
+	if err := pub.PublishWithContext(context.Background(), "x", "k.a", false, false, amqp.Publishing{Body: []byte("m")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, deliveries); string(got.Body) != "m" {
+		t.Fatalf("got %q", got.Body)
+	}
+}
+
+func TestConfirmedPublisherAfterReconnect(t *testing.T) {
+	d, m := newDropper(t)
+	ch, _ := m.Channel()
+	declareQueue(t, ch, "q")
+	pub, err := NewConfirmedPublisher(m, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	ctx := context.Background()
+	if err := pub.PublishWithContext(ctx, "x", "k.a", false, false, amqp.Publishing{Body: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	d.drop()
+	waitGen(t, m, 1)
+	for _, body := range []string{"2", "3"} {
+		if err := pub.PublishWithContext(ctx, "x", "k.a", false, false, amqp.Publishing{Body: []byte(body)}); err != nil {
+			t.Fatalf("publish %s after reconnect: %v", body, err)
+		}
+	}
+	deliveries, err := ch.Consume("q", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		if got := receive(t, deliveries); string(got.Body) != want {
+			t.Fatalf("got %q, want %q", got.Body, want)
+		}
+	}
+}
+
+func TestConfirmedPublisherReturnsAfterReconnect(t *testing.T) {
+	d, m := newDropper(t)
+	ch, _ := m.Channel()
+	declareQueue(t, ch, "q")
+	pub, err := NewConfirmedPublisher(m, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	d.drop()
+	waitGen(t, m, 1)
+	err = pub.PublishWithContext(context.Background(), "x", "nowhere", false, false, amqp.Publishing{})
+	var returned *ReturnedError
+	if !errors.As(err, &returned) {
+		t.Fatalf("got %v, want a ReturnedError", err)
+	}
+	if err := pub.PublishWithContext(context.Background(), "x", "k.a", false, false, amqp.Publishing{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManagedConsumerStopsWhenBrokerCancels(t *testing.T) {
+	d, m := newDropper(t)
+	ch, _ := m.Channel()
+	declareQueue(t, ch, "q")
+	sub, err := Subscribe(m, "x", "q", "k.*", Durable, func(string) Acktype { return Ack }, DecodeJSON[string], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := d.broker.Channel()
+	defer raw.Close()
+	if _, err := raw.(*memChannel).QueueDelete("q", false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sub.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription kept running after its queue was deleted")
+	}
+	var cancelled *CancelledError
+	if !errors.As(sub.Err(), &cancelled) {
+		t.Fatalf("Err() = %v, want a CancelledError", sub.Err())
+	}
+}
@@ -0,0 +1,164 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// RetryCountHeader counts how many times a message was sent back for
+	// another attempt with NackRetry.
+	RetryCountHeader = "x-retry-count"
+	// RetryRoutingKeyHeader keeps the routing key a retried message was
+	// published with, as it comes back under its queue's name.
+	RetryRoutingKeyHeader = "x-retry-routing-key"
+)
+
+// RetryPolicy controls NackRetry. Attempt n waits Backoff.Delay(n) in a
+// retry queue before going back to the original queue. Once MaxAttempts
+// retries have failed the message is moved to the parking queue.
+type RetryPolicy struct {
+	Backoff     Backoff
+	MaxAttempts int
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Backoff:     Backoff{Min: time.Second, Max: time.Minute},
+	MaxAttempts: 5,
+}
+
+// WithRetry enables NackRetry for the subscription and declares the retry
+// and parking queues for its queue.
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.retry = &policy
+	}
+}
+
+func RetryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", queue, delay)
+}
+
+func ParkingQueueName(queue string) string {
+	return queue + ".parking"
+}
+
+// retrier republishes on its own confirm-mode channels, so a retry is
+// only acked once the broker has taken the copy. Publishing on the
+// consuming channel would lose the message if the broker dropped the copy
+// after the ack.
+type retrier struct {
+	pub    *PublisherPool
+	queue  string
+	policy RetryPolicy
+}
+
+// declareRetryQueues declares one queue per distinct delay. Each holds
+// messages for its delay and then dead-letters them back to queue through
+// the default exchange, so other queues bound to the original exchange do
+// not see the retry.
+func declareRetryQueues(conn Broker, ch Channel, queue string, durable bool, policy RetryPolicy, workers int) (*retrier, error) {
+	declared := map[time.Duration]bool{}
+	for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
+		delay := policy.Backoff.Delay(attempt)
+		if declared[delay] {
+			continue
+		}
+		declared[delay] = true
+		_, err := ch.QueueDeclare(RetryQueueName(queue, delay), durable, false, false, false, amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not declare retry queue for %s: %w", queue, err)
+		}
+	}
+	if _, err := ch.QueueDeclare(ParkingQueueName(queue), durable, false, false, false, nil); err != nil {
+		return nil, fmt.Errorf("could not declare parking queue for %s: %w", queue, err)
+	}
+	// one channel per worker, so concurrent handlers do not wait for each
+	// other's confirms
+	pub, err := NewPublisherPool(conn, workers, true)
+	if err != nil {
+		return nil, fmt.Errorf("could not open retry channels for %s: %w", queue, err)
+	}
+	return &retrier{pub: pub, queue: queue, policy: policy}, nil
+}
+
+// retry republishes msg to the retry queue for its next attempt, or to
+// the parking queue when it has none left. It returns once the broker has
+// confirmed the copy; only then may the caller ack msg.
+func (r *retrier) retry(msg amqp.Delivery) error {
+	attempt := RetryCount(msg)
+	key := ParkingQueueName(r.queue)
+	if attempt < r.policy.MaxAttempts {
+		key = RetryQueueName(r.queue, r.policy.Backoff.Delay(attempt))
+	}
+	pub := publishingFromDelivery(msg)
+	pub.Headers[RetryCountHeader] = int64(attempt + 1)
+	if attempt == 0 {
+		pub.Headers[RetryRoutingKeyHeader] = msg.RoutingKey
+	}
+	return r.pub.PublishWithContext(context.Background(), "", key, true, false, pub)
+}
+
+// closeAfter closes the retry channels once processed is closed, that is
+// once the last message has been handled. The returned channel is closed
+// after that.
+func (r *retrier) closeAfter(processed <-chan struct{}) <-chan struct{} {
+	if r == nil {
+		return processed
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-processed
+		r.close()
+	}()
+	return done
+}
+
+func (r *retrier) close() {
+	if r != nil {
+		r.pub.Close()
+	}
+}
+
+// RetryCount is the number of retries msg has already been through.
+func RetryCount(msg amqp.Delivery) int {
+	n, _ := intArg(msg.Headers, RetryCountHeader)
+	return int(n)
+}
+
+// publishedRoutingKey is the routing key msg was first published with.
+func publishedRoutingKey(msg amqp.Delivery) string {
+	if key, ok := msg.Headers[RetryRoutingKeyHeader].(string); ok && RetryCount(msg) > 0 {
+		return key
+	}
+	return msg.RoutingKey
+}
+
+// publishingFromDelivery copies a delivery into a new message, with its
+// own headers table so it can be changed freely.
+func publishingFromDelivery(msg amqp.Delivery) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         copyTable(msg.Headers),
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
@@ -0,0 +1,99 @@
+package pubsub
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var testRetryPolicy = RetryPolicy{
+	Backoff:     Backoff{Min: 10 * time.Millisecond, Max: 20 * time.Millisecond},
+	MaxAttempts: 2,
+}
+
+func TestRetryRedeliversUntilHandled(t *testing.T) {
+	mem := newTopicBroker(t)
+	var calls atomic.Int32
+	done := make(chan int, 1)
+	sub, err := SubscribeWithMetadata(mem, "x", "q", "k.*", Durable, func(s string, meta Metadata) Acktype {
+		if calls.Add(1) < 2 {
+			return NackRetry
+		}
+		done <- RetryCount(amqp.Delivery{Headers: meta.Headers})
+		return Ack
+	}, DecodeJSON[string], nil, WithRetry(testRetryPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSub(t, sub)
+	publishRaw(t, mem, "x", "k.a", amqp.Publishing{Body: []byte(`"x"`)})
+
+	select {
+	case retries := <-done:
+		if retries != 1 {
+			t.Errorf("handled after %d retries, want 1", retries)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not retried")
+	}
+}
+
+func TestRetryParksAfterMaxAttempts(t *testing.T) {
+	mem := newTopicBroker(t)
+	var calls atomic.Int32
+	sub, err := Subscribe(mem, "x", "q", "k.*", Durable, func(string) Acktype {
+		calls.Add(1)
+		return NackRetry
+	}, DecodeJSON[string], nil, WithRetry(testRetryPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSub(t, sub)
+	publishRaw(t, mem, "x", "k.a", amqp.Publishing{Body: []byte(`"x"`)})
+
+	ch, _ := mem.Channel()
+	defer ch.Close()
+	parked, err := ch.Consume(ParkingQueueName("q"), "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, parked)
+	if got := RetryCount(msg); got != testRetryPolicy.MaxAttempts+1 {
+		t.Errorf("parked with retry count %d, want %d", got, testRetryPolicy.MaxAttempts+1)
+	}
+	if got := calls.Load(); got != int32(testRetryPolicy.MaxAttempts)+1 {
+		t.Errorf("handled %d times, want %d", got, testRetryPolicy.MaxAttempts+1)
+	}
+}
+
+func TestRetryRequeuesWhenCopyIsNotConfirmed(t *testing.T) {
+	mem := newTopicBroker(t)
+	var calls atomic.Int32
+	done := make(chan struct{})
+	// no attempts left, every retry goes to the parking queue
+	sub, err := Subscribe(mem, "x", "q", "k.*", Durable, func(string) Acktype {
+		if calls.Add(1) == 1 {
+			return NackRetry
+		}
+		close(done)
+		return Ack
+	}, DecodeJSON[string], nil, WithRetry(RetryPolicy{Backoff: testRetryPolicy.Backoff}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSub(t, sub)
+	ch, _ := mem.Channel()
+	defer ch.Close()
+	if _, err := ch.(*memChannel).QueueDelete(ParkingQueueName("q"), false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	publishRaw(t, mem, "x", "k.a", amqp.Publishing{Body: []byte(`"x"`)})
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was acked although its retry copy was returned")
+	}
+}
@@ -0,0 +1,308 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RPCErrorHeader carries the error of a failed call in place of a response.
+const RPCErrorHeader = "x-rpc-error"
+
+// CallTimeout bounds how long Call waits for a response when the caller's
+// context has no deadline.
+var CallTimeout = 5 * time.Second
+
+var ErrCallerClosed = errors.New("pubsub: caller was closed")
+
+// RemoteError is an error returned by the handler serving a call.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "pubsub: remote error: " + e.Message
+}
+
+type rpcReply struct {
+	msg amqp.Delivery
+	err error
+}
+
+// Caller sends requests and routes responses back to the waiting Call by
+// correlation ID. It owns one exclusive reply queue and can be shared by
+// any number of goroutines.
+type Caller struct {
+	channel Channel
+	queue   string
+	// publishMu serializes publishes on channel, returns arrive there too
+	publishMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]chan rpcReply
+	closed  bool
+	signer  *Signer
+}
+
+// NewCaller declares the caller's reply queue. The queue gets a fixed name
+// rather than a server-named one so a ManagedConnection can declare it
+// again under the same name after a reconnect.
+func NewCaller(conn Broker) (*Caller, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("could not open rpc channel: %w", err)
+	}
+	queue, err := ch.QueueDeclare("rpc.reply."+NewMessageID(), false, true, true, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("could not declare reply queue: %w", err)
+	}
+	replies, err := ch.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("could not consume reply queue: %w", err)
+	}
+	c := &Caller{channel: ch, queue: queue.Name, pending: map[string]chan rpcReply{}}
+	go c.receive(replies, ch.NotifyReturn(make(chan amqp.Return, 1)))
+	return c, nil
+}
+
+func (c *Caller) receive(replies <-chan amqp.Delivery, returns <-chan amqp.Return) {
+	for replies != nil {
+		select {
+		case msg, ok := <-replies:
+			if !ok {
+				replies = nil
+				continue
+			}
+			if !c.resolve(msg.CorrelationId, rpcReply{msg: msg}) {
+				Logger().Warn("late reply dropped", "correlation_id", msg.CorrelationId)
+			}
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			// nothing is serving the key, fail now instead of timing out
+			c.resolve(ret.CorrelationId, rpcReply{err: &ReturnedError{
+				Exchange:   ret.Exchange,
+				RoutingKey: ret.RoutingKey,
+				ReplyCode:  ret.ReplyCode,
+				ReplyText:  ret.ReplyText,
+			}})
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for id, reply := range c.pending {
+		close(reply)
+		delete(c.pending, id)
+	}
+}
+
+func (c *Caller) resolve(id string, reply rpcReply) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.pending[id]
+	if ok {
+		delete(c.pending, id)
+		ch <- reply
+	}
+	return ok
+}
+
+func (c *Caller) register(id string) (chan rpcReply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrCallerClosed
+	}
+	reply := make(chan rpcReply, 1)
+	c.pending[id] = reply
+	return reply, nil
+}
+
+func (c *Caller) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+// Sign signs the requests sent after it with s, for servers that only
+// answer verified players.
+func (c *Caller) Sign(s Signer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.signer = &s
+}
+
+func (c *Caller) publisher() Publisher {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.signer != nil {
+		return c.signer.Publisher(c.channel)
+	}
+	return c.channel
+}
+
+// Close fails calls still waiting with ErrCallerClosed.
+func (c *Caller) Close() error {
+	return c.channel.Close()
+}
+
+// Call sends req as JSON to exchange with routing key and waits for the
+// response of the Serve handling it. A call nothing is bound to fails with
+// a *ReturnedError, one the handler failed with a *RemoteError. The request
+// expires with the call, so a busy server does not handle requests whose
+// caller has given up.
+func Call[Req, Resp any](ctx context.Context, c *Caller, exchange, key string, req Req) (Resp, error) {
+	var resp Resp
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, CallTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	codec := JSONCodec{}
+	body, err := codec.Encode(req)
+	if err != nil {
+		return resp, fmt.Errorf("could not encode %s request: %w", key, err)
+	}
+	id := NewMessageID()
+	reply, err := c.register(id)
+	if err != nil {
+		return resp, err
+	}
+	defer c.forget(id)
+
+	var parent tracing.SpanContext
+	if s := tracing.SpanFromContext(ctx); s != nil {
+		parent = s.Context
+	}
+	span := tracing.Start("call "+key, tracing.KindClient, parent)
+	span.SetAttr("messaging.destination.name", exchange)
+	span.SetAttr("messaging.rabbitmq.destination.routing_key", key)
+	defer span.Finish()
+
+	msg := amqp.Publishing{
+		Headers:       amqp.Table{TraceParentHeader: span.Context.TraceParent()},
+		ContentType:   codec.ContentType(),
+		Body:          body,
+		MessageId:     id,
+		CorrelationId: id,
+		ReplyTo:       c.queue,
+		Expiration:    strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 1), 10),
+	}
+	stamp(&msg, req)
+	ch := c.publisher()
+	c.publishMu.Lock()
+	err = ch.PublishWithContext(ctx, exchange, key, true, false, msg)
+	c.publishMu.Unlock()
+	if err != nil {
+		span.SetError(err)
+		return resp, fmt.Errorf("could not send %s request: %w", key, err)
+	}
+	recordPublished(exchange, key)
+	resp, err = awaitReply[Resp](ctx, key, reply)
+	span.SetError(err)
+	return resp, err
+}
+
+func awaitReply[Resp any](ctx context.Context, key string, reply <-chan rpcReply) (Resp, error) {
+	var resp Resp
+	select {
+	case r, ok := <-reply:
+		if !ok {
+			return resp, ErrCallerClosed
+		}
+		if r.err != nil {
+			return resp, r.err
+		}
+		if remote, ok := r.msg.Headers[RPCErrorHeader].(string); ok {
+			return resp, &RemoteError{Message: remote}
+		}
+		resp, err := Decode[Resp](DefaultCodecs, r.msg.ContentType, r.msg.Body)
+		if err != nil {
+			return resp, fmt.Errorf("could not decode %s response: %w", key, err)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return resp, fmt.Errorf("%s call: %w", key, ctx.Err())
+	}
+}
+
+// Serve answers calls sent to key. Requests are decoded by content type
+// (see WithCodecs) and responses encoded the same way as their request. An
+// error returned by handler is sent back to the caller instead of a
+// response. Requests without a reply-to address are handled and dropped.
+func Serve[Req, Resp any](
+	conn Broker,
+	exchange, queueName, key string,
+	simpleQueueType SimpleQueueType,
+	handler func(Req, Metadata) (Resp, error),
+	opts ...SubscribeOption) (*Subscription, error) {
+	cfg := newSubscribeConfig(opts)
+	// one channel per worker, so concurrent replies do not wait for each other
+	replies, err := NewPublisherPool(conn, cfg.concurrency, false)
+	if err != nil {
+		return nil, fmt.Errorf("could not open reply channel: %w", err)
+	}
+	respond := func(_ context.Context, req Req, meta Metadata) Acktype {
+		resp, err := handler(req, meta)
+		if meta.ReplyTo == "" {
+			return Ack
+		}
+		msg, err := encodeReply(cfg.codecs, meta, resp, err)
+		if err != nil {
+			Logger().Error("could not encode response", "routing_key", key, "message_id", meta.MessageID, "error", err)
+			msg = amqp.Publishing{Headers: amqp.Table{RPCErrorHeader: err.Error()}, CorrelationId: meta.CorrelationID}
+		}
+		msg.Headers = copyTable(msg.Headers)
+		msg.Headers[TraceParentHeader] = meta.TraceParent
+		stamp(&msg, resp)
+		if err := replies.PublishWithContext(context.Background(), "", meta.ReplyTo, false, false, msg); err != nil {
+			Logger().Error("could not send response", "routing_key", key, "message_id", meta.MessageID, "error", err)
+			return NackRequeue
+		}
+		recordPublished("", meta.ReplyTo)
+		return Ack
+	}
+	processor := &MessageProcessor[Req]{handler: respond, decodeHandler: decodeByContentType[Req](cfg.codecs), concurrency: 1}
+	sub, err := subscribe(conn, exchange, queueName, key, simpleQueueType, processor, nil, cfg)
+	if err != nil {
+		replies.Close()
+		return nil, err
+	}
+	go func() {
+		<-sub.Done()
+		replies.Close()
+	}()
+	return sub, nil
+}
+
+func encodeReply(codecs *CodecRegistry, meta Metadata, resp any, handlerErr error) (amqp.Publishing, error) {
+	msg := amqp.Publishing{CorrelationId: meta.CorrelationID}
+	if handlerErr != nil {
+		msg.Headers = amqp.Table{RPCErrorHeader: handlerErr.Error()}
+		return msg, nil
+	}
+	codec, err := codecs.Lookup(meta.ContentType)
+	if err != nil {
+		return msg, err
+	}
+	body, err := codec.Encode(resp)
+	if err != nil {
+		return msg, err
+	}
+	msg.ContentType = codec.ContentType()
+	msg.Body = body
+	return msg, nil
+}
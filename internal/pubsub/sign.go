@@ -0,0 +1,218 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// SignatureHeader carries the Ed25519 signature of a message, made with
+	// the key certified by CertificateHeader.
+	SignatureHeader = "x-signature"
+	// CertificateHeader carries the sender's Certificate.
+	CertificateHeader = "x-certificate"
+)
+
+var (
+	ErrUnsigned     = errors.New("pubsub: message is not signed")
+	ErrUntrusted    = errors.New("pubsub: certificate is not trusted")
+	ErrBadSignature = errors.New("pubsub: signature does not match sender")
+)
+
+// Certificate vouches that PublicKey belongs to Username for one session.
+// It is issued by an Authority, so anyone knowing the authority's public
+// key can verify players, not just the server.
+type Certificate struct {
+	Username  string
+	Session   string
+	PublicKey ed25519.PublicKey
+	Signature []byte
+}
+
+func (c Certificate) payload() []byte {
+	var buf bytes.Buffer
+	for _, field := range [][]byte{[]byte("peril-certificate"), []byte(c.Username), []byte(c.Session), c.PublicKey} {
+		writeField(&buf, field)
+	}
+	return buf.Bytes()
+}
+
+// Encode returns c in the form sent in CertificateHeader.
+func (c Certificate) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// ParseCertificate reverses Certificate.Encode.
+func ParseCertificate(s string) (Certificate, error) {
+	var cert Certificate
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return cert, fmt.Errorf("could not decode certificate: %w", err)
+	}
+	if err := json.Unmarshal(data, &cert); err != nil {
+		return cert, fmt.Errorf("could not decode certificate: %w", err)
+	}
+	if len(cert.PublicKey) != ed25519.PublicKeySize {
+		return cert, fmt.Errorf("certificate of %q has no valid public key", cert.Username)
+	}
+	return cert, nil
+}
+
+// Authority issues certificates. Servers built from the same seed issue
+// certificates the others accept.
+type Authority struct {
+	key ed25519.PrivateKey
+}
+
+// NewAuthority derives the authority's key from secret.
+func NewAuthority(secret []byte) *Authority {
+	seed := sha256.Sum256(secret)
+	return &Authority{key: ed25519.NewKeyFromSeed(seed[:])}
+}
+
+// GenerateAuthority returns an authority with a random key.
+func GenerateAuthority() (*Authority, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate authority key: %w", err)
+	}
+	return &Authority{key: key}, nil
+}
+
+// PublicKey is what verifiers need to trust the authority's certificates.
+func (a *Authority) PublicKey() ed25519.PublicKey {
+	return a.key.Public().(ed25519.PublicKey)
+}
+
+// Issue certifies that key belongs to username for session.
+func (a *Authority) Issue(username, session string, key ed25519.PublicKey) Certificate {
+	cert := Certificate{Username: username, Session: session, PublicKey: key}
+	cert.Signature = ed25519.Sign(a.key, cert.payload())
+	return cert
+}
+
+// Verifier decides whether messages signed under a certificate are
+// accepted.
+type Verifier interface {
+	VerifyCertificate(cert Certificate) error
+}
+
+// TrustedAuthority accepts every certificate issued by the authority with
+// this public key.
+type TrustedAuthority ed25519.PublicKey
+
+func (a TrustedAuthority) VerifyCertificate(cert Certificate) error {
+	if len(a) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(a), cert.payload(), cert.Signature) {
+		return fmt.Errorf("%w for %q", ErrUntrusted, cert.Username)
+	}
+	return nil
+}
+
+// Signer signs messages published through its Publisher as the player
+// named by Certificate, with the private key it certifies. The signature
+// covers the routing key and the body as sent, so the Signer has to wrap
+// the channel inside any Compression.
+type Signer struct {
+	Certificate Certificate
+	Key         ed25519.PrivateKey
+}
+
+func (s Signer) Publisher(ch Publisher) Publisher {
+	return &signingPublisher{wrapper: wrapper{ch}, signer: s, cert: s.Certificate.Encode()}
+}
+
+type signingPublisher struct {
+	wrapper
+	signer Signer
+	cert   string
+}
+
+func (p *signingPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if len(p.signer.Key) > 0 {
+		msg.Headers = copyTable(msg.Headers)
+		// a signature vouches for exactly one sender
+		sender := p.signer.Certificate.Username
+		msg.Headers[SenderHeader] = sender
+		msg.Headers[CertificateHeader] = p.cert
+		sig := ed25519.Sign(p.signer.Key, signedPayload(sender, key, msg.MessageId, msg.ContentType, msg.ContentEncoding, msg.Body))
+		msg.Headers[SignatureHeader] = base64.StdEncoding.EncodeToString(sig)
+	}
+	return p.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// signedPayload binds the body to its routing key, so a signed message
+// cannot be replayed under another player's key or another topic.
+func signedPayload(sender, routingKey, messageID, contentType, contentEncoding string, body []byte) []byte {
+	var buf bytes.Buffer
+	for _, field := range []string{sender, routingKey, messageID, contentType, contentEncoding} {
+		writeField(&buf, []byte(field))
+	}
+	writeField(&buf, body)
+	return buf.Bytes()
+}
+
+// writeField length-prefixes data so fields cannot be shifted into each
+// other.
+func writeField(w io.Writer, data []byte) {
+	fmt.Fprintf(w, "%d:", len(data))
+	w.Write(data)
+}
+
+// Verify checks that msg was signed by the sender it names, under a
+// certificate v accepts, for the routing key it was published with. A
+// message coming back from a retry queue arrives under its queue's name
+// and is checked against the routing key the retrier recorded; that
+// header can be forged by anyone allowed to publish to the default
+// exchange, so deny clients that permission where it matters.
+func Verify(msg amqp.Delivery, v Verifier) error {
+	encoded, _ := msg.Headers[SignatureHeader].(string)
+	certHeader, _ := msg.Headers[CertificateHeader].(string)
+	if encoded == "" || certHeader == "" {
+		return ErrUnsigned
+	}
+	sender, _ := msg.Headers[SenderHeader].(string)
+	cert, err := ParseCertificate(certHeader)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUntrusted, err)
+	}
+	if err := v.VerifyCertificate(cert); err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || cert.Username != sender ||
+		!ed25519.Verify(cert.PublicKey, signedPayload(sender, publishedRoutingKey(msg), msg.MessageId, msg.ContentType, msg.ContentEncoding, msg.Body), sig) {
+		return fmt.Errorf("%w %q", ErrBadSignature, sender)
+	}
+	return nil
+}
+
+// SenderCertificate is the certificate a message was signed under, once
+// WithVerifier has checked it.
+func SenderCertificate(meta Metadata) (Certificate, bool) {
+	if !meta.Verified {
+		return Certificate{}, false
+	}
+	encoded, _ := meta.Headers[CertificateHeader].(string)
+	cert, err := ParseCertificate(encoded)
+	return cert, err == nil
+}
+
+// WithVerifier discards messages that are unsigned or whose signature
+// does not match their sender, before they are decoded. Only then is
+// Metadata.Sender trustworthy.
+func WithVerifier(v Verifier) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.verifier = v
+	}
+}
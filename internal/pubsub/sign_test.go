@@ -0,0 +1,115 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// newSigner certifies a fresh key for username with authority.
+func newSigner(t *testing.T, authority *Authority, username string) Signer {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Signer{Certificate: authority.Issue(username, NewMessageID(), public), Key: private}
+}
+
+// signed returns msg as delivered after publishing it through s.
+func signed(t *testing.T, s Signer, msg amqp.Publishing) amqp.Delivery {
+	t.Helper()
+	target := &recordingPublisher{}
+	if err := s.Publisher(target).PublishWithContext(context.Background(), "x", "k.a", false, false, msg); err != nil {
+		t.Fatal(err)
+	}
+	out := target.msgs[0]
+	return amqp.Delivery{RoutingKey: target.keys[0], Headers: out.Headers, MessageId: out.MessageId, ContentType: out.ContentType, ContentEncoding: out.ContentEncoding, Body: out.Body}
+}
+
+func TestVerifyAcceptsCertifiedSender(t *testing.T) {
+	authority, err := GenerateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := signed(t, newSigner(t, authority, "alice"), amqp.Publishing{MessageId: "m1", Body: []byte("move")})
+	if err := Verify(msg, TrustedAuthority(authority.PublicKey())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyRejectsForgeries(t *testing.T) {
+	authority, _ := GenerateAuthority()
+	other, _ := GenerateAuthority()
+	trusted := TrustedAuthority(authority.PublicKey())
+	alice := newSigner(t, authority, "alice")
+
+	tampered := signed(t, alice, amqp.Publishing{Body: []byte("move")})
+	tampered.Body = []byte("other move")
+	renamed := signed(t, alice, amqp.Publishing{Body: []byte("move")})
+	renamed.Headers[SenderHeader] = "bob"
+	rerouted := signed(t, alice, amqp.Publishing{Body: []byte("move")})
+	rerouted.RoutingKey = "k.bob"
+	selfIssued := signed(t, newSigner(t, other, "bob"), amqp.Publishing{Body: []byte("move")})
+	unsigned := amqp.Delivery{Headers: amqp.Table{SenderHeader: "bob"}, Body: []byte("move")}
+
+	for name, c := range map[string]struct {
+		msg  amqp.Delivery
+		want error
+	}{
+		"tampered body":       {tampered, ErrBadSignature},
+		"renamed sender":      {renamed, ErrBadSignature},
+		"other routing key":   {rerouted, ErrBadSignature},
+		"untrusted authority": {selfIssued, ErrUntrusted},
+		"unsigned":            {unsigned, ErrUnsigned},
+	} {
+		if err := Verify(c.msg, trusted); !errors.Is(err, c.want) {
+			t.Errorf("%s: Verify = %v, want %v", name, err, c.want)
+		}
+	}
+}
+
+func TestAuthoritiesFromSameSecretAgree(t *testing.T) {
+	a := NewAuthority([]byte("secret"))
+	b := NewAuthority([]byte("secret"))
+	msg := signed(t, newSigner(t, a, "alice"), amqp.Publishing{Body: []byte("log")})
+	if err := Verify(msg, TrustedAuthority(b.PublicKey())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAcceptsRetriedMessage(t *testing.T) {
+	authority, _ := GenerateAuthority()
+	alice := newSigner(t, authority, "alice")
+	mem := newTopicBroker(t)
+	verified := make(chan Metadata, 1)
+	sub, err := SubscribeWithMetadata(mem, "x", "q", "k.*", Durable, func(_ string, meta Metadata) Acktype {
+		if RetryCount(amqp.Delivery{Headers: meta.Headers}) == 0 {
+			return NackRetry
+		}
+		verified <- meta
+		return Ack
+	}, DecodeJSON[string], nil, WithVerifier(TrustedAuthority(authority.PublicKey())), WithRetry(testRetryPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSub(t, sub)
+	ch, _ := mem.Channel()
+	defer ch.Close()
+	if err := PublishJSON(alice.Publisher(ch), "x", "k.a", "move"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case meta := <-verified:
+		if !meta.Verified || meta.RoutingKey != "q" {
+			t.Errorf("retried message under %s, verified %v", meta.RoutingKey, meta.Verified)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("retried message failed verification")
+	}
+}
@@ -0,0 +1,125 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// CancelledError reports a consumer that the broker cancelled, e.g.
+// because its queue was deleted.
+type CancelledError struct {
+	Consumer string
+}
+
+func (e *CancelledError) Error() string {
+	return fmt.Sprintf("pubsub: consumer %s was cancelled by the broker", e.Consumer)
+}
+
+// Subscription is a running consumer started by Subscribe.
+type Subscription struct {
+	channel  Channel
+	consumer string
+	done     chan struct{}
+
+	mu      sync.Mutex
+	err     error
+	closing bool
+}
+
+func newSubscription(ch Channel, consumer string, processed <-chan struct{}) *Subscription {
+	s := &Subscription{
+		channel:  ch,
+		consumer: consumer,
+		done:     make(chan struct{}),
+	}
+	cancels := ch.NotifyCancel(make(chan string, 1))
+	closes := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go s.watch(processed, cancels, closes)
+	return s
+}
+
+func (s *Subscription) watch(processed <-chan struct{}, cancels <-chan string, closes <-chan *amqp.Error) {
+	defer close(s.done)
+	for {
+		select {
+		case tag, ok := <-cancels:
+			if !ok {
+				cancels = nil
+				continue
+			}
+			if tag == s.consumer {
+				s.fail(&CancelledError{Consumer: tag})
+			}
+		case err, ok := <-closes:
+			if ok && err != nil {
+				s.fail(err)
+			}
+			closes = nil
+		case <-processed:
+			// the delivery channel may close just before the reason arrives
+			select {
+			case tag, ok := <-cancels:
+				if ok && tag == s.consumer {
+					s.fail(&CancelledError{Consumer: tag})
+				}
+			case err, ok := <-closes:
+				if ok && err != nil {
+					s.fail(err)
+				}
+			default:
+			}
+			return
+		}
+	}
+}
+
+func (s *Subscription) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil && !s.closing {
+		s.err = err
+	}
+}
+
+// Done is closed once the subscription has stopped and its last message
+// has been handled.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err explains why the subscription stopped. It is nil while it is running
+// and after a Close.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close stops consuming, waits for in-flight messages to be handled and
+// then closes the channel. If ctx expires first the channel is closed
+// anyway, which requeues unacknowledged messages, and ctx's error is
+// returned.
+func (s *Subscription) Close(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+
+	if err := s.channel.Cancel(s.consumer, false); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		s.channel.Close()
+		return err
+	}
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		s.channel.Close()
+		return ctx.Err()
+	}
+	if err := s.channel.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return err
+	}
+	return nil
+}
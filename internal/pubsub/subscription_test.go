@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// queueLength is how many messages wait in queue.
+func queueLength(t *testing.T, mem *MemoryBroker, queue string) int {
+	t.Helper()
+	ch, _ := mem.Channel()
+	defer ch.Close()
+	q, err := ch.(*memChannel).QueueDeclarePassive(queue, true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q.Messages
+}
+
+// blockingSubscription subscribes a handler to "q" that signals started
+// and waits for release before acking.
+func blockingSubscription(t *testing.T, mem *MemoryBroker) (*Subscription, chan struct{}) {
+	t.Helper()
+	started, release := make(chan struct{}), make(chan struct{})
+	sub, err := Subscribe(mem, "x", "q", "k.*", Durable, func(string) Acktype {
+		close(started)
+		<-release
+		return Ack
+	}, DecodeJSON[string], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishRaw(t, mem, "x", "k.a", amqp.Publishing{Body: []byte(`"x"`)})
+	<-started
+	return sub, release
+}
+
+func TestSubscriptionCloseWaitsForHandlers(t *testing.T) {
+	mem := newTopicBroker(t)
+	sub, release := blockingSubscription(t, mem)
+
+	closed := make(chan error)
+	go func() { closed <- sub.Close(context.Background()) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned %v while a handler was running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not return after the handler finished")
+	}
+	if n := queueLength(t, mem, "q"); n != 0 {
+		t.Errorf("%d messages left in the queue, the handled one was not acked", n)
+	}
+	if err := sub.Err(); err != nil {
+		t.Errorf("Err() = %v after Close", err)
+	}
+}
+
+func TestSubscriptionCloseTimesOut(t *testing.T) {
+	mem := newTopicBroker(t)
+	sub, release := blockingSubscription(t, mem)
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := sub.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// the channel closed under the handler, so its message is requeued
+	if n := queueLength(t, mem, "q"); n != 1 {
+		t.Errorf("%d messages in the queue, want the unacked one back", n)
+	}
+}
+
+func TestSubscriptionErrReportsBrokerCancel(t *testing.T) {
+	mem := newTopicBroker(t)
+	sub, err := Subscribe(mem, "x", "q", "k.*", Durable, func(string) Acktype { return Ack }, DecodeJSON[string], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Err() != nil {
+		t.Fatalf("Err() = %v while running", sub.Err())
+	}
+	ch, _ := mem.Channel()
+	defer ch.Close()
+	if _, err := ch.(*memChannel).QueueDelete("q", false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sub.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription kept running after its queue was deleted")
+	}
+	var cancelled *CancelledError
+	if !errors.As(sub.Err(), &cancelled) {
+		t.Fatalf("Err() = %v, want a CancelledError", sub.Err())
+	}
+}
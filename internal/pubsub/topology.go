@@ -0,0 +1,294 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Topology describes the exchanges, queues and bindings an application
+// needs. Queues that are created per player or per subscriber are left out,
+// their names are only known at runtime.
+type Topology struct {
+	Exchanges []ExchangeSpec `json:"exchanges"`
+	Queues    []QueueSpec    `json:"queues"`
+	Bindings  []BindingSpec  `json:"bindings"`
+}
+
+type ExchangeSpec struct {
+	Name       string         `json:"name"`
+	Type       string         `json:"type"`
+	Durable    bool           `json:"durable"`
+	AutoDelete bool           `json:"autoDelete,omitempty"`
+	Internal   bool           `json:"internal,omitempty"`
+	Arguments  map[string]any `json:"arguments,omitempty"`
+}
+
+type QueueSpec struct {
+	Name       string `json:"name"`
+	Durable    bool   `json:"durable"`
+	AutoDelete bool   `json:"autoDelete,omitempty"`
+	Exclusive  bool   `json:"exclusive,omitempty"`
+	// DeadLetterExchange and DeadLetterRoutingKey are shorthands for the
+	// x-dead-letter-* arguments.
+	DeadLetterExchange   string         `json:"deadLetterExchange,omitempty"`
+	DeadLetterRoutingKey string         `json:"deadLetterRoutingKey,omitempty"`
+	Arguments            map[string]any `json:"arguments,omitempty"`
+}
+
+type BindingSpec struct {
+	Exchange string `json:"exchange"`
+	Queue    string `json:"queue"`
+	Key      string `json:"key"`
+}
+
+// ParseTopology reads a JSON topology and validates it.
+func ParseTopology(data []byte) (*Topology, error) {
+	var t Topology
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("could not parse topology: %w", err)
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func LoadTopology(path string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTopology(data)
+}
+
+// Validate checks that names are unique, exchange types are known and
+// bindings and dead-letter settings refer to declared entities.
+func (t *Topology) Validate() error {
+	var errs []error
+	for i, ex := range t.Exchanges {
+		if ex.Name == "" {
+			errs = append(errs, fmt.Errorf("exchange %d has no name", i))
+		}
+		switch ex.Type {
+		case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+		default:
+			errs = append(errs, fmt.Errorf("exchange %s has unknown type %q", ex.Name, ex.Type))
+		}
+		if t.exchangeIndex(ex.Name) != i {
+			errs = append(errs, fmt.Errorf("exchange %s is declared twice", ex.Name))
+		}
+	}
+	for i, q := range t.Queues {
+		if q.Name == "" {
+			errs = append(errs, fmt.Errorf("queue %d has no name", i))
+		}
+		if t.queueIndex(q.Name) != i {
+			errs = append(errs, fmt.Errorf("queue %s is declared twice", q.Name))
+		}
+		// "" is the default exchange, which always exists
+		if q.DeadLetterExchange != "" && !t.HasExchange(q.DeadLetterExchange) {
+			errs = append(errs, fmt.Errorf("queue %s dead-letters to undeclared exchange %s", q.Name, q.DeadLetterExchange))
+		}
+	}
+	for _, b := range t.Bindings {
+		if !t.HasExchange(b.Exchange) {
+			errs = append(errs, fmt.Errorf("binding %s -> %s: undeclared exchange", b.Exchange, b.Queue))
+		}
+		if !t.HasQueue(b.Queue) {
+			errs = append(errs, fmt.Errorf("binding %s -> %s: undeclared queue", b.Exchange, b.Queue))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t *Topology) exchangeIndex(name string) int {
+	for i, ex := range t.Exchanges {
+		if ex.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *Topology) queueIndex(name string) int {
+	for i, q := range t.Queues {
+		if q.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *Topology) HasExchange(name string) bool {
+	return t.exchangeIndex(name) >= 0
+}
+
+func (t *Topology) HasQueue(name string) bool {
+	return t.queueIndex(name) >= 0
+}
+
+func (t *Topology) HasBinding(exchange, queue, key string) bool {
+	for _, b := range t.Bindings {
+		if b.Exchange == exchange && b.Queue == queue && b.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Args are the arguments the queue is declared with.
+func (q QueueSpec) Args() amqp.Table {
+	if len(q.Arguments) == 0 && q.DeadLetterExchange == "" && q.DeadLetterRoutingKey == "" {
+		return nil
+	}
+	args := amqp.Table{}
+	for k, v := range q.Arguments {
+		args[k] = tableValue(v)
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	return args
+}
+
+func (ex ExchangeSpec) Args() amqp.Table {
+	if len(ex.Arguments) == 0 {
+		return nil
+	}
+	args := amqp.Table{}
+	for k, v := range ex.Arguments {
+		args[k] = tableValue(v)
+	}
+	return args
+}
+
+// tableValue turns JSON numbers into integers where they are whole, as
+// RabbitMQ expects for arguments like x-message-ttl.
+func tableValue(v any) any {
+	if f, ok := v.(float64); ok && f == float64(int64(f)) {
+		return int64(f)
+	}
+	return v
+}
+
+// Apply declares everything in t. Declaring is idempotent, so Apply is safe
+// to run on every start; it fails if an entity exists with other settings.
+func (t *Topology) Apply(conn Broker) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	for _, ex := range t.Exchanges {
+		if err := ch.ExchangeDeclare(ex.Name, ex.Type, ex.Durable, ex.AutoDelete, ex.Internal, false, ex.Args()); err != nil {
+			return fmt.Errorf("could not declare exchange %s: %w", ex.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		if _, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args()); err != nil {
+			return fmt.Errorf("could not declare queue %s: %w", q.Name, err)
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := ch.QueueBind(b.Queue, b.Key, b.Exchange, false, nil); err != nil {
+			return fmt.Errorf("could not bind queue %s to %s with %q: %w", b.Queue, b.Exchange, b.Key, err)
+		}
+	}
+	return nil
+}
+
+// passiveDeclarer looks entities up without creating them. *amqp.Channel
+// implements it.
+type passiveDeclarer interface {
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+}
+
+// TopologyDiff is one way the broker differs from a Topology.
+type TopologyDiff struct {
+	Kind   string // "exchange" or "queue"
+	Name   string
+	Reason string
+}
+
+func (d TopologyDiff) String() string {
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Name, d.Reason)
+}
+
+// Check compares t with the broker without changing anything that is
+// missing. Entities that exist are redeclared with t's settings, which the
+// broker refuses if they differ. AMQP cannot list bindings, so bindings are
+// not checked.
+func (t *Topology) Check(conn Broker) ([]TopologyDiff, error) {
+	var diffs []TopologyDiff
+	for _, ex := range t.Exchanges {
+		reason, err := checkEntity(conn, func(ch passiveDeclarer) error {
+			return ch.ExchangeDeclarePassive(ex.Name, ex.Type, ex.Durable, ex.AutoDelete, ex.Internal, false, nil)
+		}, func(ch Channel) error {
+			return ch.ExchangeDeclare(ex.Name, ex.Type, ex.Durable, ex.AutoDelete, ex.Internal, false, ex.Args())
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not check exchange %s: %w", ex.Name, err)
+		}
+		if reason != "" {
+			diffs = append(diffs, TopologyDiff{Kind: "exchange", Name: ex.Name, Reason: reason})
+		}
+	}
+	for _, q := range t.Queues {
+		reason, err := checkEntity(conn, func(ch passiveDeclarer) error {
+			_, err := ch.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, nil)
+			return err
+		}, func(ch Channel) error {
+			_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args())
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not check queue %s: %w", q.Name, err)
+		}
+		if reason != "" {
+			diffs = append(diffs, TopologyDiff{Kind: "queue", Name: q.Name, Reason: reason})
+		}
+	}
+	return diffs, nil
+}
+
+// checkEntity returns why an entity does not match, or "" if it does. A
+// failed declaration closes the channel, so every step gets a new one.
+func checkEntity(conn Broker, exists func(passiveDeclarer) error, declare func(Channel) error) (string, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return "", err
+	}
+	passive, ok := ch.(passiveDeclarer)
+	if !ok {
+		ch.Close()
+		return "", errors.New("broker cannot look up entities")
+	}
+	err = exists(passive)
+	ch.Close()
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+		return "missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	ch, err = conn.Channel()
+	if err != nil {
+		return "", err
+	}
+	defer ch.Close()
+	err = declare(ch)
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		return amqpErr.Reason, nil
+	}
+	return "", err
+}
@@ -0,0 +1,74 @@
+package pubsub
+
+import (
+	"slices"
+	"testing"
+)
+
+const testTopology = `{
+	"exchanges": [
+		{"name": "peril_topic", "type": "topic", "durable": true},
+		{"name": "peril_dlx", "type": "fanout", "durable": true}
+	],
+	"queues": [
+		{"name": "game_logs", "durable": true, "deadLetterExchange": "peril_dlx", "arguments": {"x-message-ttl": 60000}},
+		{"name": "peril_dlq", "durable": true}
+	],
+	"bindings": [
+		{"exchange": "peril_topic", "queue": "game_logs", "key": "game_logs.*"},
+		{"exchange": "peril_dlx", "queue": "peril_dlq", "key": ""}
+	]
+}`
+
+func TestTopologyCheckFindsDrift(t *testing.T) {
+	applied, err := ParseTopology([]byte(testTopology))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := NewMemoryBroker()
+	if err := applied.Apply(mem); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := applied.Check(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Fatalf("applied topology differs from itself: %v", diffs)
+	}
+
+	drifted, _ := ParseTopology([]byte(testTopology))
+	drifted.Exchanges[1].Type = "direct"
+	drifted.Queues[0].Arguments["x-message-ttl"] = 1000.0
+	drifted.Queues = append(drifted.Queues, QueueSpec{Name: "war", Durable: true})
+	diffs, err = drifted.Check(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.Kind+" "+d.Name)
+	}
+	want := []string{"exchange peril_dlx", "queue game_logs", "queue war"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("diffs = %v, want %v", diffs, want)
+	}
+	if diffs[2].Reason != "missing" {
+		t.Errorf("undeclared queue reported as %q", diffs[2].Reason)
+	}
+	// Check must not create what is missing
+	if diffs, _ := drifted.Check(mem); len(diffs) != 3 {
+		t.Errorf("second check found %v", diffs)
+	}
+}
+
+func TestTopologyValidateRejectsDanglingReferences(t *testing.T) {
+	_, err := ParseTopology([]byte(`{
+		"exchanges": [{"name": "a", "type": "nope"}],
+		"queues": [{"name": "q", "deadLetterExchange": "gone"}],
+		"bindings": [{"exchange": "b", "queue": "q", "key": "#"}]
+	}`))
+	if err == nil {
+		t.Fatal("invalid topology parsed")
+	}
+}
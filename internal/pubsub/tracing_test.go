@@ -0,0 +1,88 @@
+package pubsub
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
+)
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans map[[8]byte]*tracing.Span
+}
+
+func (r *spanRecorder) ExportSpan(s *tracing.Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans[s.Context.SpanID] = s
+}
+
+func (r *spanRecorder) span(id [8]byte) *tracing.Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.spans[id]
+}
+
+func TestTraceParentFollowsCausedBy(t *testing.T) {
+	rec := &spanRecorder{spans: map[[8]byte]*tracing.Span{}}
+	tracing.SetExporter(rec)
+	t.Cleanup(func() { tracing.SetExporter(nil) })
+	root := tracing.Start("command", tracing.KindInternal, tracing.SpanContext{})
+
+	mem := newTopicBroker(t)
+	replies := &recordingPublisher{}
+	handled := make(chan Metadata, 1)
+	sub, err := SubscribeWithMetadata(mem, "x", "q", "k.*", Durable, func(_ string, meta Metadata) Acktype {
+		if err := PublishJSON(CausedBy(replies, meta), "x", "reply.a", "done"); err != nil {
+			t.Error(err)
+		}
+		handled <- meta
+		return Ack
+	}, DecodeJSON[string], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, _ := mem.Channel()
+	defer ch.Close()
+	if err := PublishJSON(Envelope{TraceParent: root.Context.TraceParent()}.Publisher(ch), "x", "k.a", "go"); err != nil {
+		t.Fatal(err)
+	}
+
+	var meta Metadata
+	select {
+	case meta = <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not handled")
+	}
+	// the process span is exported once the handler has returned
+	closeSub(t, sub)
+	process, ok := tracing.ParseTraceParent(meta.TraceParent)
+	if !ok {
+		t.Fatalf("handler got traceparent %q", meta.TraceParent)
+	}
+	reply, ok := tracing.ParseTraceParent(replies.msgs[0].Headers[TraceParentHeader].(string))
+	if !ok || reply.TraceID != root.Context.TraceID {
+		t.Fatalf("reply is not in the trace of the command")
+	}
+
+	// reply publish -> process -> publish -> command
+	want := []string{"publish x", "process q", "publish x", "command"}
+	id := reply.SpanID
+	for i, name := range want {
+		var s *tracing.Span
+		if i == len(want)-1 {
+			s = root
+		} else {
+			s = rec.span(id)
+		}
+		if s == nil || s.Name != name || s.Context.TraceID != root.Context.TraceID {
+			t.Fatalf("span %d of the chain is %+v, want %s", i, s, name)
+		}
+		if i == 1 && s.Context.SpanID != process.SpanID {
+			t.Fatalf("reply was not published from the span handling the message")
+		}
+		id = s.Parent
+	}
+}
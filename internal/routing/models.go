@@ -11,3 +11,52 @@ type GameLog struct {
 	Message     string
 	Username    string
 }
+
+type JoinRequest struct {
+	Username string
+	// PublicKey is the ed25519 key the player signs with for this session
+	PublicKey []byte
+}
+
+type JoinResponse struct {
+	IsPaused bool
+	Players  []string
+	// Certificate vouches for the player's PublicKey, see pubsub.Signer
+	Certificate string
+	// AuthorityKey verifies every player's certificate, see
+	// pubsub.TrustedAuthority
+	AuthorityKey []byte
+	// GameKeyID and GameKey encrypt game traffic, see pubsub.Encryption
+	GameKeyID string
+	GameKey   []byte
+}
+
+type LeaveRequest struct {
+	Username string
+}
+
+// Presence is a player's heartbeat, signed for the session it keeps
+// alive. Every server hears it, also those the player did not join.
+type Presence struct {
+	Username string
+	// Leaving ends the session at once instead of letting it expire
+	Leaving bool
+	// SentAt keeps a heartbeat from being replayed after SessionTTL
+	SentAt time.Time
+}
+
+type PlayersRequest struct{}
+
+type PlayersResponse struct {
+	Players []string
+}
+
+type GameKeyRequest struct {
+	Username string
+	KeyID    string
+}
+
+type GameKeyResponse struct {
+	KeyID string
+	Key   []byte
+}
@@ -1,5 +1,7 @@
 package routing
 
+import "time"
+
 const (
 	ArmyMovesPrefix = "army_moves"
 
@@ -8,9 +10,42 @@ const (
 	PauseKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	// PresencePrefix keys the heartbeats of every player, see Presence
+	PresencePrefix = "presence"
+)
+
+// Clients announce their session every HeartbeatInterval. Servers forget
+// a session they have not heard of for SessionTTL, so the name of a client
+// that crashed is free again soon after.
+const (
+	HeartbeatInterval = 10 * time.Second
+	SessionTTL        = 3 * HeartbeatInterval
+)
+
+// RPC keys, each served by the server on a queue of the same name
+const (
+	JoinKey       = "rpc.join"
+	LeaveKey      = "rpc.leave"
+	PlayersKey    = "rpc.players"
+	PauseStateKey = "rpc.pause_state"
+	GameKeyKey    = "rpc.game_key"
 )
 
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
+	ExchangePerilDLX    = "peril_dlx"
+)
+
+const DeadLetterQueue = "peril_dlq"
+
+// Each player may publish this many messages per second on average, in
+// bursts of up to the burst size. Clients hold themselves to it and
+// consumers drop what goes beyond it.
+const (
+	GameLogRate   = 5
+	GameLogBurst  = 20
+	ArmyMoveRate  = 2
+	ArmyMoveBurst = 5
 )
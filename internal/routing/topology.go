@@ -0,0 +1,11 @@
+package routing
+
+import _ "embed"
+
+// TopologySpec declares the exchanges and shared queues of the game, see
+// pubsub.Topology. Per-player queues are declared by the client. Keep it in
+// step with the constants in this package; the server checks them against
+// it at startup.
+//
+//go:embed topology.json
+var TopologySpec []byte
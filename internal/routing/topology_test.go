@@ -0,0 +1,61 @@
+package routing_test
+
+import (
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// The server and clients declare game_logs and war again when they
+// subscribe, which fails if the topology gives them other arguments.
+func TestTopologyMatchesSubscriptions(t *testing.T) {
+	topology, err := pubsub.ParseTopology(routing.TopologySpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := pubsub.NewMemoryBroker()
+	if err := topology.Apply(mem); err != nil {
+		t.Fatal(err)
+	}
+	deadLetters := pubsub.QueueOptions{DeadLetterExchange: routing.ExchangePerilDLX}.Table()
+	for _, q := range []struct{ name, key string }{
+		{"game_logs", routing.GameLogSlug + ".*"},
+		{"war", routing.WarRecognitionsPrefix + ".*"},
+	} {
+		ch, _, err := pubsub.DeclareAndBind(mem, routing.ExchangePerilTopic, q.name, q.key, pubsub.Quorum, deadLetters)
+		if err != nil {
+			t.Fatalf("%s: %v", q.name, err)
+		}
+		ch.Close()
+	}
+}
+
+// Messages that keep failing in game_logs and war end up in the
+// dead-letter queue instead of being redelivered forever.
+func TestSharedQueuesAreQuorumQueues(t *testing.T) {
+	topology, err := pubsub.ParseTopology(routing.TopologySpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{routing.GameLogSlug, routing.WarRecognitionsPrefix} {
+		var args map[string]any
+		for _, q := range topology.Queues {
+			if q.Name == name {
+				args = q.Args()
+			}
+		}
+		if args == nil {
+			t.Fatalf("queue %s is not declared", name)
+		}
+		if typ := args["x-queue-type"]; typ != "quorum" {
+			t.Errorf("%s: x-queue-type = %v, want quorum", name, typ)
+		}
+		if limit := args["x-delivery-limit"]; limit != int64(pubsub.DefaultDeliveryLimit) {
+			t.Errorf("%s: x-delivery-limit = %v (%T), want %d", name, limit, limit, pubsub.DefaultDeliveryLimit)
+		}
+		if dlx := args["x-dead-letter-exchange"]; dlx != routing.ExchangePerilDLX {
+			t.Errorf("%s: x-dead-letter-exchange = %v, want %s", name, dlx, routing.ExchangePerilDLX)
+		}
+	}
+}
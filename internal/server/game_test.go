@@ -0,0 +1,125 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/client"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/server"
+)
+
+// player types commands into a client or the server. Each command only
+// returns once the previous one was handled, as the next line is not read
+// before that.
+type player struct {
+	t    *testing.T
+	name string
+	in   *io.PipeWriter
+	done chan error
+}
+
+func start(t *testing.T, name string, run func(io.Reader) error) *player {
+	t.Helper()
+	r, w := io.Pipe()
+	p := &player{t: t, name: name, in: w, done: make(chan error, 1)}
+	go func() { p.done <- run(r) }()
+	t.Cleanup(func() { w.Close() })
+	return p
+}
+
+func (p *player) typeLine(line string) {
+	p.t.Helper()
+	if _, err := io.WriteString(p.in, line+"\n"); err != nil {
+		p.t.Fatalf("%s: %v", p.name, err)
+	}
+}
+
+// do types the commands and waits until the last one was handled.
+func (p *player) do(lines ...string) {
+	p.t.Helper()
+	for _, line := range lines {
+		p.typeLine(line)
+	}
+	// the reader takes a line only after the one before, so the second
+	// empty line is read once the last command is done
+	p.typeLine("")
+	p.typeLine("")
+}
+
+func (p *player) wait() {
+	p.t.Helper()
+	select {
+	case err := <-p.done:
+		if err != nil {
+			p.t.Errorf("%s stopped: %v", p.name, err)
+		}
+	case <-time.After(10 * time.Second):
+		p.t.Fatalf("%s did not stop", p.name)
+	}
+}
+
+// Two players start a war over Europe, fought by the attacker's client and
+// logged by the server, all on one in-memory broker.
+func TestWarIsFoughtAndLogged(t *testing.T) {
+	dir := t.TempDir()
+	// the server writes game.log to its working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	topology, err := pubsub.ParseTopology(routing.TopologySpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := pubsub.NewMemoryBroker()
+	defer mem.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := start(t, "server", func(input io.Reader) error {
+		return server.Run(ctx, mem, input, topology)
+	})
+	srv.do("resume")
+	clientRun := func(name string) func(io.Reader) error {
+		return func(input io.Reader) error {
+			return client.Run(mem, input, pubsub.Compression{}, filepath.Join(dir, name+".outbox"))
+		}
+	}
+	alice := start(t, "alice", clientRun("alice"))
+	alice.do("alice", "spawn europe infantry")
+	bob := start(t, "bob", clientRun("bob"))
+	bob.do("bob", "spawn asia infantry", "move europe 1")
+
+	// alice declares war on bob's move; the war queue is shared, so it may
+	// reach her first, but only bob fights it
+	want := "bob: A war between bob and alice resulted in a draw"
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		logged, err := os.ReadFile(filepath.Join(dir, "game.log"))
+		if err == nil && strings.Contains(string(logged), want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("game.log = %q, want a line %q", logged, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	alice.typeLine("quit")
+	alice.wait()
+	bob.typeLine("quit")
+	bob.wait()
+	srv.typeLine("exit")
+	srv.wait()
+}
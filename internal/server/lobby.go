@@ -0,0 +1,257 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+var (
+	// errNotPlaying rejects certificates of players who left, went
+	// silent or never joined.
+	errNotPlaying = errors.New("player is not in the game")
+	// errStaleSession rejects certificates of a session the player has
+	// since replaced.
+	errStaleSession = errors.New("session is no longer active")
+)
+
+// lobby is what the server knows about the game, answered to clients over
+// RPC.
+type lobby struct {
+	authority *pubsub.Authority
+	gameKeys  *pubsub.Keyring
+	// ttl is how long a session lasts without a heartbeat
+	ttl time.Duration
+
+	mu     sync.Mutex
+	paused bool
+	// players maps each player to their latest session
+	players map[string]session
+}
+
+type session struct {
+	id       string
+	lastSeen time.Time
+}
+
+func newLobby(authority *pubsub.Authority, gameKeys *pubsub.Keyring) *lobby {
+	return &lobby{authority: authority, gameKeys: gameKeys, ttl: routing.SessionTTL, players: map[string]session{}}
+}
+
+// live returns the player's session if it has not expired.
+func (l *lobby) live(username string) (session, bool) {
+	s, ok := l.players[username]
+	if !ok || time.Since(s.lastSeen) >= l.ttl {
+		return session{}, false
+	}
+	return s, true
+}
+
+// VerifyCertificate accepts certificates of the authority for the live
+// session of their player, whether they joined here or at another server
+// sharing the signing secret.
+func (l *lobby) VerifyCertificate(cert pubsub.Certificate) error {
+	if err := pubsub.TrustedAuthority(l.authority.PublicKey()).VerifyCertificate(cert); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.live(cert.Username)
+	if !ok {
+		return fmt.Errorf("%s: %w", cert.Username, errNotPlaying)
+	}
+	if s.id != cert.Session {
+		return fmt.Errorf("%s: %w", cert.Username, errStaleSession)
+	}
+	return nil
+}
+
+func (l *lobby) setPaused(paused bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.paused = paused
+}
+
+func (l *lobby) playerList() []string {
+	players := make([]string, 0, len(l.players))
+	for p := range l.players {
+		if _, ok := l.live(p); ok {
+			players = append(players, p)
+		}
+	}
+	sort.Strings(players)
+	return players
+}
+
+// handleJoin certifies the player's key and hands them the current game
+// key. Every player gets the same game key, so encryption hides the game
+// from the broker and from clients that never joined, not from other
+// players: anyone who joins can read every move sealed while they hold
+// it, including moves of other players. Rotation only stops a player who
+// left from reading what is sealed after the next rotation.
+func (l *lobby) handleJoin(req routing.JoinRequest, _ pubsub.Metadata) (routing.JoinResponse, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if req.Username == "" {
+		return routing.JoinResponse{}, fmt.Errorf("username is required")
+	}
+	// a name is free again once its player has left, or once their
+	// client stopped sending heartbeats
+	if _, ok := l.live(req.Username); ok {
+		return routing.JoinResponse{}, fmt.Errorf("username %s is already playing", req.Username)
+	}
+	if len(req.PublicKey) != ed25519.PublicKeySize {
+		return routing.JoinResponse{}, fmt.Errorf("a public key is required")
+	}
+	id := pubsub.NewMessageID()
+	cert := l.authority.Issue(req.Username, id, req.PublicKey)
+	gameKeyID, gameKey, _ := l.gameKeys.Current()
+	l.players[req.Username] = session{id: id, lastSeen: time.Now()}
+	slog.Info("player joined", "username", req.Username, "session", id)
+	return routing.JoinResponse{
+		IsPaused:     l.paused,
+		Players:      l.playerList(),
+		Certificate:  cert.Encode(),
+		AuthorityKey: l.authority.PublicKey(),
+		GameKeyID:    gameKeyID,
+		GameKey:      gameKey,
+	}, nil
+}
+
+// handleLeave is served WithVerifier(l), so meta.Sender signed the request
+// with their current session.
+func (l *lobby) handleLeave(req routing.LeaveRequest, meta pubsub.Metadata) (struct{}, error) {
+	if meta.Sender != req.Username {
+		return struct{}{}, fmt.Errorf("%s cannot leave for %s", meta.Sender, req.Username)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.players, req.Username)
+	slog.Info("player left", "username", req.Username)
+	return struct{}{}, nil
+}
+
+// handlePresence keeps sessions alive, also those of players who joined
+// another server. A heartbeat establishes a session this server has not
+// seen yet, unless the name is taken by another live session.
+func (l *lobby) handlePresence(p routing.Presence, meta pubsub.Metadata) pubsub.Acktype {
+	cert, ok := pubsub.SenderCertificate(meta)
+	if !ok || p.Username != meta.Sender {
+		slog.Warn("discarded heartbeat sent on behalf of another player", "username", p.Username, "sender", meta.Sender)
+		return pubsub.NackDiscard
+	}
+	if time.Since(p.SentAt) >= l.ttl {
+		// late or replayed, the session may have ended since
+		return pubsub.Ack
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current, live := l.live(p.Username)
+	if live && current.id != cert.Session {
+		slog.Warn("ignored heartbeat of a replaced session", "username", p.Username, "session", cert.Session)
+		return pubsub.Ack
+	}
+	if p.Leaving {
+		// the server answering the leave request already removed them
+		if live {
+			delete(l.players, p.Username)
+			slog.Info("player left", "username", p.Username)
+		}
+		return pubsub.Ack
+	}
+	if !live {
+		slog.Info("player is online", "username", p.Username, "session", cert.Session)
+	}
+	l.players[p.Username] = session{id: cert.Session, lastSeen: time.Now()}
+	return pubsub.Ack
+}
+
+func (l *lobby) handlePlayers(routing.PlayersRequest, pubsub.Metadata) (routing.PlayersResponse, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return routing.PlayersResponse{Players: l.playerList()}, nil
+}
+
+func (l *lobby) handlePauseState(struct{}, pubsub.Metadata) (routing.PlayingState, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return routing.PlayingState{IsPaused: l.paused}, nil
+}
+
+// handleGameKey hands out keys rotated in after a player joined. Like
+// handleLeave it only answers the verified player.
+func (l *lobby) handleGameKey(req routing.GameKeyRequest, meta pubsub.Metadata) (routing.GameKeyResponse, error) {
+	if meta.Sender != req.Username {
+		return routing.GameKeyResponse{}, fmt.Errorf("%s cannot fetch keys for %s", meta.Sender, req.Username)
+	}
+	l.mu.Lock()
+	_, joined := l.live(req.Username)
+	l.mu.Unlock()
+	if !joined {
+		return routing.GameKeyResponse{}, fmt.Errorf("%s has not joined the game", req.Username)
+	}
+	key, ok := l.gameKeys.Key(req.KeyID)
+	if !ok {
+		return routing.GameKeyResponse{}, fmt.Errorf("unknown key %s", req.KeyID)
+	}
+	return routing.GameKeyResponse{KeyID: req.KeyID, Key: key}, nil
+}
+
+// rotateGameKey starts sealing game traffic with a new key. Old keys are
+// kept so messages still in flight can be read.
+func (l *lobby) rotateGameKey() error {
+	id, key, err := pubsub.GenerateKey()
+	if err != nil {
+		return err
+	}
+	if err := l.gameKeys.Rotate(id, key); err != nil {
+		return err
+	}
+	slog.Info("game key rotated", "key_id", id)
+	return nil
+}
+
+// serve starts answering every lobby query.
+func (l *lobby) serve(connection pubsub.Broker) ([]*pubsub.Subscription, error) {
+	exchange := routing.ExchangePerilDirect
+	servers := []func() (*pubsub.Subscription, error){
+		func() (*pubsub.Subscription, error) {
+			return pubsub.Serve(connection, exchange, routing.JoinKey, routing.JoinKey, pubsub.Durable, l.handleJoin, pubsub.WithMiddleware(pubsub.Recover[routing.JoinRequest]()))
+		},
+		func() (*pubsub.Subscription, error) {
+			return pubsub.Serve(connection, exchange, routing.LeaveKey, routing.LeaveKey, pubsub.Durable, l.handleLeave, pubsub.WithVerifier(l), pubsub.WithMiddleware(pubsub.Recover[routing.LeaveRequest]()))
+		},
+		func() (*pubsub.Subscription, error) {
+			return pubsub.Serve(connection, exchange, routing.PlayersKey, routing.PlayersKey, pubsub.Durable, l.handlePlayers, pubsub.WithMiddleware(pubsub.Recover[routing.PlayersRequest]()))
+		},
+		func() (*pubsub.Subscription, error) {
+			return pubsub.Serve(connection, exchange, routing.GameKeyKey, routing.GameKeyKey, pubsub.Durable, l.handleGameKey, pubsub.WithVerifier(l), pubsub.WithMiddleware(pubsub.Recover[routing.GameKeyRequest]()))
+		},
+		func() (*pubsub.Subscription, error) {
+			return pubsub.Serve(connection, exchange, routing.PauseStateKey, routing.PauseStateKey, pubsub.Durable, l.handlePauseState, pubsub.WithMiddleware(pubsub.Recover[struct{}]()))
+		},
+		func() (*pubsub.Subscription, error) {
+			// every server needs every heartbeat, so each gets its own queue;
+			// the sessions they announce may not be known here yet
+			queue := strings.Join([]string{routing.PresencePrefix, pubsub.NewMessageID()}, ".")
+			return pubsub.SubscribeWithMetadata(connection, routing.ExchangePerilTopic, queue, routing.PresencePrefix+".*", pubsub.Transient, l.handlePresence, pubsub.DecodeJSON, nil, pubsub.WithVerifier(pubsub.TrustedAuthority(l.authority.PublicKey())), pubsub.WithMiddleware(pubsub.Recover[routing.Presence]()))
+		},
+	}
+	var subs []*pubsub.Subscription
+	for _, serve := range servers {
+		sub, err := serve()
+		if err != nil {
+			return subs, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
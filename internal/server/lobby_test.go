@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func newTestLobby(t *testing.T, authority *pubsub.Authority, ttl time.Duration) *lobby {
+	t.Helper()
+	l := newLobby(authority, pubsub.NewKeyring())
+	l.ttl = ttl
+	if err := l.rotateGameKey(); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// joinAs joins username and returns the signer of the new session.
+func joinAs(t *testing.T, l *lobby, username string) (pubsub.Signer, error) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := l.handleJoin(routing.JoinRequest{Username: username, PublicKey: public}, pubsub.Metadata{})
+	if err != nil {
+		return pubsub.Signer{}, err
+	}
+	cert, err := pubsub.ParseCertificate(resp.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pubsub.Signer{Certificate: cert, Key: private}, nil
+}
+
+func TestSilentSessionFreesTheName(t *testing.T) {
+	authority, err := pubsub.GenerateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTestLobby(t, authority, 50*time.Millisecond)
+	crashed, err := joinAs(t, l, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := joinAs(t, l, "alice"); err == nil {
+		t.Fatal("joined with the name of a live session")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if players := l.playerList(); len(players) != 0 {
+		t.Errorf("expired session still listed: %v", players)
+	}
+	if _, err := joinAs(t, l, "alice"); err != nil {
+		t.Fatalf("name not freed after the session expired: %v", err)
+	}
+	if err := l.VerifyCertificate(crashed.Certificate); !errors.Is(err, errStaleSession) {
+		t.Errorf("certificate of the replaced session: got %v, want %v", err, errStaleSession)
+	}
+}
+
+func TestVerifyCertificateOnlyAcceptsLiveSessions(t *testing.T) {
+	authority, err := pubsub.GenerateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTestLobby(t, authority, time.Minute)
+	alice, err := joinAs(t, l, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.VerifyCertificate(alice.Certificate); err != nil {
+		t.Fatalf("live session: %v", err)
+	}
+	public, _, _ := ed25519.GenerateKey(rand.Reader)
+	unknown := authority.Issue("mallory", pubsub.NewMessageID(), public)
+	if err := l.VerifyCertificate(unknown); !errors.Is(err, errNotPlaying) {
+		t.Errorf("player who never joined: got %v, want %v", err, errNotPlaying)
+	}
+	if _, err := l.handleLeave(routing.LeaveRequest{Username: "alice"}, pubsub.Metadata{Sender: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.VerifyCertificate(alice.Certificate); !errors.Is(err, errNotPlaying) {
+		t.Errorf("player who left: got %v, want %v", err, errNotPlaying)
+	}
+}
+
+// A player joins one server and sends heartbeats, which another server
+// sharing the signing secret adopts as a session.
+func TestHeartbeatsReachOtherServers(t *testing.T) {
+	secret := []byte("shared secret")
+	here := newTestLobby(t, pubsub.NewAuthority(secret), time.Minute)
+	there := newTestLobby(t, pubsub.NewAuthority(secret), time.Minute)
+	mem := pubsub.NewMemoryBroker()
+	topology, err := pubsub.ParseTopology(routing.TopologySpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := topology.Apply(mem); err != nil {
+		t.Fatal(err)
+	}
+	subs, err := there.serve(mem)
+	for _, sub := range subs {
+		defer sub.Close(context.Background())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := joinAs(t, here, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := there.VerifyCertificate(alice.Certificate); !errors.Is(err, errNotPlaying) {
+		t.Fatalf("before any heartbeat: got %v, want %v", err, errNotPlaying)
+	}
+	ch, err := mem.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	announcer := pubsub.Envelope{Sender: "alice"}.Publisher(alice.Publisher(ch))
+	publish := func(p routing.Presence) {
+		t.Helper()
+		p.SentAt = time.Now()
+		if err := pubsub.PublishJSON(announcer, routing.ExchangePerilTopic, routing.PresencePrefix+".alice", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor := func(want error) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			err := there.VerifyCertificate(alice.Certificate)
+			if errors.Is(err, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got %v, want %v", err, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// a heartbeat in another player's name is ignored
+	publish(routing.Presence{Username: "bob"})
+	publish(routing.Presence{Username: "alice"})
+	waitFor(nil)
+	if players := there.playerList(); len(players) != 1 || players[0] != "alice" {
+		t.Errorf("players: got %v, want [alice]", players)
+	}
+	publish(routing.Presence{Username: "alice", Leaving: true})
+	waitFor(errNotPlaying)
+}
@@ -0,0 +1,244 @@
+// Package server is the Peril server: it runs the lobby, pauses and
+// resumes the game on the commands of its input and writes game logs.
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// AppID identifies the server in the envelope of every message it sends.
+const AppID = "peril-server"
+
+const shutdownTimeout = 10 * time.Second
+
+// pauseTimeout is how long pause and resume wait for a blocked broker.
+const pauseTimeout = 5 * time.Second
+
+const signingSecretEnv = "PERIL_SIGNING_SECRET"
+
+// gameKeyRotation is how long a game key encrypts new messages.
+const gameKeyRotation = time.Hour
+
+// rateLimits are what players are allowed to send, see routing.GameLogRate.
+var rateLimits = map[string]pubsub.RateLimit{
+	routing.GameLogSlug:     {Rate: routing.GameLogRate, Burst: routing.GameLogBurst},
+	routing.ArmyMovesPrefix: {Rate: routing.ArmyMoveRate, Burst: routing.ArmyMoveBurst},
+}
+
+// quotaReport is how often players over their quota are reported.
+const quotaReport = time.Minute
+
+// moveAuditQueue gets a copy of every army move, so the server sees players
+// moving faster than allowed. The clients drop such moves themselves.
+const moveAuditQueue = "peril_move_audit"
+
+// WriteLog takes about a second per entry, so logs are written in parallel
+const logWorkers = 10
+
+// redelivered game logs are recognised by message ID so game.log gets
+// every entry once, also across restarts
+const (
+	dedupFile     = "game_logs.seen"
+	dedupCapacity = 10000
+	dedupTTL      = 24 * time.Hour
+)
+
+// Run serves the game against any broker with the commands read from
+// input, so the server can be driven by an in-memory broker as well as
+// RabbitMQ. It returns once ctx is done, the exit command is read or the
+// game logs can no longer be consumed.
+func Run(ctx context.Context, connection pubsub.Broker, input io.Reader, topology *pubsub.Topology) error {
+	pool, err := pubsub.NewPublisherPool(connection, pubsub.DefaultPoolSize, false)
+	if err != nil {
+		return fmt.Errorf("could not open publisher channels: %w", err)
+	}
+	defer pool.Close()
+	flow := pubsub.WatchFlow(connection)
+	channel := flow.Publisher(pubsub.Envelope{AppID: AppID}.Publisher(pool), 0)
+	if err := topology.Apply(connection); err != nil {
+		return fmt.Errorf("could not declare topology: %w", err)
+	}
+	authority, err := signingAuthority()
+	if err != nil {
+		return fmt.Errorf("could not create signing authority: %w", err)
+	}
+	gameKeys := pubsub.NewKeyring()
+	lobby := newLobby(authority, gameKeys)
+	if err := lobby.rotateGameKey(); err != nil {
+		return fmt.Errorf("could not create game key: %w", err)
+	}
+	pubsub.PublishJSON(channel, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+	lobby.setPaused(true)
+	queries, err := lobby.serve(connection)
+	if err != nil {
+		return fmt.Errorf("could not serve lobby queries: %w", err)
+	}
+	gamelogic.PrintServerHelp()
+
+	done := make(chan struct{})
+	// stopErr is why the server stopped on its own, set before done closes
+	var stopErr error
+	seenLogs, err := pubsub.NewDedupStore(dedupCapacity, dedupTTL, dedupFile)
+	if err != nil {
+		return fmt.Errorf("could not open dedup store %s: %w", dedupFile, err)
+	}
+	defer seenLogs.Close()
+	// logs beyond a player's quota, and logs still failing after
+	// pubsub.DefaultDeliveryLimit redeliveries, are dead-lettered instead
+	// of written
+	deadLetters := pubsub.QueueOptions{DeadLetterExchange: routing.ExchangePerilDLX}.Table()
+	quota := pubsub.NewQuota(rateLimits)
+	logs, err := pubsub.SubscribeByContentType(connection, routing.ExchangePerilTopic, "game_logs", "game_logs.*", pubsub.Quorum, handleLogs, deadLetters, pubsub.WithConcurrency(logWorkers), pubsub.WithRetry(pubsub.DefaultRetryPolicy), pubsub.WithDedup(seenLogs), pubsub.WithVerifier(lobby), pubsub.WithDecryption(gameKeys), pubsub.WithMiddleware(pubsub.Recover[routing.GameLog](), pubsub.Logging[routing.GameLog](nil), loggedBySender, pubsub.Enforce[routing.GameLog](quota, pubsub.NackDiscard)))
+	if err != nil {
+		return fmt.Errorf("could not subscribe to game logs: %w", err)
+	}
+	moves, err := pubsub.SubscribeWithMetadata(connection, routing.ExchangePerilTopic, moveAuditQueue, routing.ArmyMovesPrefix+".*", pubsub.Transient, auditMove, pubsub.DecodeJSON, nil, pubsub.WithVerifier(lobby), pubsub.WithDecryption(gameKeys), pubsub.WithMiddleware(pubsub.Enforce[gamelogic.ArmyMove](quota, pubsub.Ack)))
+	if err != nil {
+		return fmt.Errorf("could not audit army moves: %w", err)
+	}
+	report := time.NewTicker(quotaReport)
+	defer report.Stop()
+	rotation := time.NewTicker(gameKeyRotation)
+	defer rotation.Stop()
+	// input is read on its own goroutine so the loop below only wakes up
+	// for a command, a timer or shutdown
+	commands := make(chan []string)
+	go func() {
+		defer close(commands)
+		in := gamelogic.NewInput(input)
+		for {
+			words, ok := in.Next()
+			if !ok {
+				return
+			}
+			commands <- words
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-report.C:
+				for _, o := range quota.Offenders() {
+					slog.Warn("player went over the message quota", "username", o.Sender, "routing_prefix", o.RoutingPrefix, "dropped", o.Dropped, "first", o.First, "last", o.Last)
+				}
+			case <-rotation.C:
+				if err := lobby.rotateGameKey(); err != nil {
+					slog.Error("could not rotate game key", "error", err)
+				}
+			case <-ctx.Done():
+				slog.Info("shutting down")
+				close(done)
+				return
+			case <-logs.Done():
+				stopErr = fmt.Errorf("game logs subscription stopped: %w", logs.Err())
+				close(done)
+				return
+			case words, ok := <-commands:
+				if !ok {
+					// no terminal, e.g. in a container: keep serving
+					commands = nil
+					continue
+				}
+				if len(words) == 0 {
+					continue
+				}
+
+				switch words[0] {
+				case "pause":
+					fmt.Println("pause command detected. Sending message...")
+					pauseCtx, cancel := context.WithTimeout(context.Background(), pauseTimeout)
+					err := pubsub.PublishJSONContext(pauseCtx, channel, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+					cancel()
+					if err != nil {
+						slog.Error("could not publish pause", "error", err)
+					} else {
+						lobby.setPaused(true)
+					}
+				case "resume":
+					fmt.Println("resume command detected. Sending message...")
+					pauseCtx, cancel := context.WithTimeout(context.Background(), pauseTimeout)
+					err := pubsub.PublishJSONContext(pauseCtx, channel, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: false})
+					cancel()
+					if err != nil {
+						slog.Error("could not publish resume", "error", err)
+					} else {
+						lobby.setPaused(false)
+					}
+				case "exit":
+					fmt.Println("Exiting the game...")
+					close(done)
+					return
+				default:
+					fmt.Printf("I don't know what %s means\n", words[0])
+				}
+			}
+		}
+	}()
+
+	<-done
+	fmt.Println("Closing the program...")
+	// let the log currently being written finish before disconnecting
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := logs.Close(shutdownCtx); err != nil {
+		slog.Error("could not close game logs subscription", "error", err)
+	}
+	if err := moves.Close(shutdownCtx); err != nil {
+		slog.Error("could not close army move audit", "error", err)
+	}
+	for _, query := range queries {
+		if err := query.Close(shutdownCtx); err != nil {
+			slog.Error("could not close lobby query", "error", err)
+		}
+	}
+	stats := seenLogs.Stats()
+	slog.Info("game logs written", "processed", stats.Processed, "duplicates", stats.Duplicates)
+	return stopErr
+}
+
+// signingAuthority derives the key certifying players from
+// PERIL_SIGNING_SECRET, so servers sharing the secret accept each other's
+// players once their heartbeats arrive. Without it certificates only last
+// until the server restarts.
+func signingAuthority() (*pubsub.Authority, error) {
+	if secret := os.Getenv(signingSecretEnv); secret != "" {
+		return pubsub.NewAuthority([]byte(secret)), nil
+	}
+	slog.Warn("no signing secret set, players have to rejoin after a restart", "env", signingSecretEnv)
+	return pubsub.GenerateAuthority()
+}
+
+// loggedBySender discards game logs written in another player's name. The
+// signature only proves who sent the log, not whose log it claims to be.
+func loggedBySender(next pubsub.Handler[routing.GameLog]) pubsub.Handler[routing.GameLog] {
+	return func(ctx context.Context, gamelog routing.GameLog, meta pubsub.Metadata) pubsub.Acktype {
+		if gamelog.Username != meta.Sender {
+			slog.Warn("discarded game log sent on behalf of another player", "username", gamelog.Username, "sender", meta.Sender)
+			return pubsub.NackDiscard
+		}
+		return next(ctx, gamelog, meta)
+	}
+}
+
+// auditMove only lets Enforce count the move.
+func auditMove(move gamelogic.ArmyMove, meta pubsub.Metadata) pubsub.Acktype {
+	return pubsub.Ack
+}
+
+func handleLogs(gamelog routing.GameLog) pubsub.Acktype {
+	err := gamelogic.WriteLog(gamelog)
+	if err != nil {
+		slog.Warn("could not write game log", "username", gamelog.Username, "error", err)
+		return pubsub.NackRetry
+	}
+	return pubsub.Ack
+}
@@ -0,0 +1,137 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// WriterExporter writes each span as one line of OTLP/JSON, the format of
+// the OpenTelemetry collector's file exporter, so the files can be loaded
+// into any OTLP-compatible trace viewer.
+type WriterExporter struct {
+	service string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterExporter(w io.Writer, service string) *WriterExporter {
+	return &WriterExporter{w: w, service: service}
+}
+
+// NewExporter picks an exporter by destination: "stdout", "stderr" or a
+// file path to append to. The returned close function releases the file.
+func NewExporter(dest, service string) (Exporter, func() error, error) {
+	switch dest {
+	case "stdout":
+		return NewWriterExporter(os.Stdout, service), func() error { return nil }, nil
+	case "stderr":
+		return NewWriterExporter(os.Stderr, service), func() error { return nil }, nil
+	}
+	f, err := os.OpenFile(dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open trace file: %v", err)
+	}
+	return NewWriterExporter(f, service), f.Close, nil
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+const (
+	statusOK    = 1
+	statusError = 2
+)
+
+func (e *WriterExporter) ExportSpan(s *Span) {
+	s.mu.Lock()
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.Context.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.Context.SpanID[:]),
+		Name:              s.Name,
+		Kind:              int(s.Kind),
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: statusOK},
+	}
+	if s.Parent != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.Parent[:])
+	}
+	if s.Err != nil {
+		span.Status = otlpStatus{Code: statusError, Message: s.Err.Error()}
+	}
+	span.Attributes = attrs(s.Attributes)
+	s.mu.Unlock()
+
+	scope := otlpScopeSpans{Spans: []otlpSpan{span}}
+	scope.Scope.Name = "peril/pubsub"
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = attrs(map[string]string{"service.name": e.service})
+	line, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{resource}})
+	if err != nil {
+		slog.Error("could not encode span", "error", err)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := e.w.Write(append(line, '\n')); err != nil {
+		slog.Error("could not export span", "error", err)
+	}
+}
+
+func attrs(m map[string]string) []otlpAttr {
+	out := make([]otlpAttr, 0, len(m))
+	for k, v := range m {
+		out = append(out, otlpAttr{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}